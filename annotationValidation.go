@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	foundation "github.com/estafette/estafette-foundation"
+)
+
+var (
+	// service account ids are derived from the name, so it's restricted to the characters allowed in an account id
+	serviceAccountNameRegex = regexp.MustCompile(`^[a-z][-a-z0-9]*$`)
+	secretKeyRegex          = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+	booleanSecretAnnotations = []string{
+		annotationGCPServiceAccountDisableKeyRotation,
+		annotationGCPServiceAccountDerivedFields,
+		annotationGCPServiceAccountHmacKeys,
+		annotationGCPServiceAccountKeepPreviousKey,
+		annotationGCPServiceAccountRestartWorkloads,
+		annotationGCPServiceAccountConsumerAwarePurge,
+	}
+	hoursSecretAnnotations = []string{
+		annotationGCPServiceAccountKeyRotationAfterHours,
+		annotationGCPServiceAccountPurgeKeysAfterHours,
+	}
+	freeFormSecretAnnotations = []string{
+		annotationGCPServiceAccountDockerRegistries,
+		annotationGCPServiceAccountReenableKeys,
+		annotationGCPServiceAccountRevokeNow,
+		annotationGCPServiceAccountRotateNow,
+		annotationGCPServiceAccountState,
+	}
+	// updates of only these annotations are always admitted; the state is written by the controller itself and revoking or rotating a key mustn't be blocked by an unrelated invalid annotation
+	alwaysAdmittedAnnotations = []string{
+		annotationGCPServiceAccountState,
+		annotationGCPServiceAccountRevokeNow,
+		annotationGCPServiceAccountRotateNow,
+	}
+)
+
+// validateSecretAnnotations returns a message for each estafette.io/gcp-service-account* annotation on a secret that is malformed, unknown or not allowed by the controller; if changedKeys isn't nil only those annotations are validated
+func validateSecretAnnotations(annotations map[string]string, changedKeys []string) (messages []string) {
+
+	messages = validateCommonAnnotations(annotations, changedKeys)
+
+	for key, value := range getControllerAnnotations(annotations) {
+		if changedKeys != nil && !foundation.StringArrayContains(changedKeys, key) {
+			continue
+		}
+		switch {
+		case key == annotationGCPServiceAccount || key == annotationGCPServiceAccountName:
+			// validated in validateCommonAnnotations
+
+		case foundation.StringArrayContains(booleanSecretAnnotations, key):
+			boolValue, err := strconv.ParseBool(value)
+			if err != nil {
+				messages = append(messages, fmt.Sprintf("Annotation %v has value '%v', but should be 'true' or 'false'", key, value))
+			} else if key == annotationGCPServiceAccountDisableKeyRotation && boolValue && !*allowDisableKeyRotationOverride {
+				messages = append(messages, fmt.Sprintf("Annotation %v is not allowed, because this controller doesn't allow disabling key rotation", key))
+			}
+
+		case foundation.StringArrayContains(hoursSecretAnnotations, key):
+			hours, err := strconv.Atoi(value)
+			if err != nil || hours <= 0 {
+				messages = append(messages, fmt.Sprintf("Annotation %v has value '%v', but should be a positive number of hours", key, value))
+			}
+
+		case key == annotationGCPServiceAccountFilename:
+			if !secretKeyRegex.MatchString(value) {
+				messages = append(messages, fmt.Sprintf("Annotation %v has value '%v', but should be a valid secret key consisting of alphanumeric characters, '-', '_' or '.'", key, value))
+			}
+
+		case key == annotationGCPServiceAccountPermissions:
+			var permissions []GCPServiceAccountPermission
+			err := json.Unmarshal([]byte(value), &permissions)
+			if err != nil {
+				messages = append(messages, fmt.Sprintf("Annotation %v should be a json array of objects with a project and role, like [{\"project\":\"my-project\",\"role\":\"roles/storage.objectViewer\"}]: %v", key, err))
+				break
+			}
+			for i, permission := range permissions {
+				if permission.Project == "" || permission.Role == "" {
+					messages = append(messages, fmt.Sprintf("Annotation %v has a permission at index %v without a project or role", key, i))
+				}
+			}
+
+		case key == annotationGCPServiceAccountTemplates:
+			var templates map[string]string
+			err := json.Unmarshal([]byte(value), &templates)
+			if err != nil {
+				messages = append(messages, fmt.Sprintf("Annotation %v should be a json object of secret keys and templates: %v", key, err))
+				break
+			}
+			// a filename set on the namespace isn't known here; the controller rejects templates colliding with it when rendering
+			filename, ok := annotations[annotationGCPServiceAccountFilename]
+			if !ok {
+				filename = "service-account-key.json"
+			}
+			reservedKeys := getReservedSecretKeys(filename)
+			for templateKey, templateString := range templates {
+				if !secretKeyRegex.MatchString(templateKey) {
+					messages = append(messages, fmt.Sprintf("Annotation %v has entry '%v', but it should be a valid secret key consisting of alphanumeric characters, '-', '_' or '.'", key, templateKey))
+				}
+				if foundation.StringArrayContains(reservedKeys, templateKey) {
+					messages = append(messages, fmt.Sprintf("Annotation %v has entry '%v', but that entry is written by the controller itself", key, templateKey))
+				}
+				_, err := template.New(templateKey).Funcs(secretTemplateFuncs).Parse(templateString)
+				if err != nil {
+					messages = append(messages, fmt.Sprintf("Annotation %v has a template for entry '%v' that can't be parsed: %v", key, templateKey, err))
+				}
+			}
+
+		case key == annotationGCPServiceAccountMaintenanceWindows:
+			_, err := parseMaintenanceWindows(value)
+			if err != nil {
+				messages = append(messages, fmt.Sprintf("Annotation %v is invalid: %v", key, err))
+			}
+
+		case key == annotationGCPServiceAccountMaintenanceWindowsTimezone:
+			_, err := time.LoadLocation(value)
+			if err != nil {
+				messages = append(messages, fmt.Sprintf("Annotation %v has value '%v', but should be a timezone like 'Europe/Amsterdam': %v", key, value, err))
+			}
+
+		case foundation.StringArrayContains(freeFormSecretAnnotations, key):
+
+		default:
+			messages = append(messages, fmt.Sprintf("Annotation %v is unknown", key))
+		}
+	}
+
+	sort.Strings(messages)
+
+	return
+}
+
+// validateServiceAccountAnnotations returns a message for each estafette.io/gcp-service-account* annotation on a kubernetes service account that is malformed, unknown or not supported for service accounts; if changedKeys isn't nil only those annotations are validated
+func validateServiceAccountAnnotations(annotations map[string]string, changedKeys []string) (messages []string) {
+
+	messages = validateCommonAnnotations(annotations, changedKeys)
+
+	for key := range getControllerAnnotations(annotations) {
+		if changedKeys != nil && !foundation.StringArrayContains(changedKeys, key) {
+			continue
+		}
+		if key != annotationGCPServiceAccount && key != annotationGCPServiceAccountName && key != annotationGCPServiceAccountState {
+			messages = append(messages, fmt.Sprintf("Annotation %v is not supported on service accounts", key))
+		}
+	}
+
+	sort.Strings(messages)
+
+	return
+}
+
+// validateCommonAnnotations validates the annotations to enable the controller and name the service account, shared by secrets and service accounts
+func validateCommonAnnotations(annotations map[string]string, changedKeys []string) (messages []string) {
+
+	if changedKeys != nil && !foundation.StringArrayContains(changedKeys, annotationGCPServiceAccount) && !foundation.StringArrayContains(changedKeys, annotationGCPServiceAccountName) {
+		return
+	}
+
+	enabledValue, ok := annotations[annotationGCPServiceAccount]
+	if !ok {
+		return
+	}
+
+	enabled, err := strconv.ParseBool(enabledValue)
+	if err != nil {
+		return append(messages, fmt.Sprintf("Annotation %v has value '%v', but should be 'true' or 'false'", annotationGCPServiceAccount, enabledValue))
+	}
+	if !enabled {
+		return
+	}
+
+	name, ok := annotations[annotationGCPServiceAccountName]
+	switch {
+	case !ok || name == "":
+		messages = append(messages, fmt.Sprintf("Annotation %v is required when %v is 'true'", annotationGCPServiceAccountName, annotationGCPServiceAccount))
+	case len(name) < 5:
+		messages = append(messages, fmt.Sprintf("Annotation %v has value '%v', but should be at least 5 characters", annotationGCPServiceAccountName, name))
+	case len(name) > 69:
+		messages = append(messages, fmt.Sprintf("Annotation %v has value '%v', but should be at most 69 characters", annotationGCPServiceAccountName, name))
+	case !serviceAccountNameRegex.MatchString(name):
+		messages = append(messages, fmt.Sprintf("Annotation %v has value '%v', but should start with a lowercase letter and consist of lowercase letters, digits and '-'", annotationGCPServiceAccountName, name))
+	}
+
+	return
+}
+
+// getControllerAnnotations returns the estafette.io/gcp-service-account* annotations
+func getControllerAnnotations(annotations map[string]string) map[string]string {
+
+	controllerAnnotations := map[string]string{}
+	for key, value := range annotations {
+		if strings.HasPrefix(key, annotationGCPServiceAccount) {
+			controllerAnnotations[key] = value
+		}
+	}
+
+	return controllerAnnotations
+}
+
+// getChangedControllerAnnotations returns the estafette.io/gcp-service-account* annotations that have been added, changed or removed, leaving out the always admitted ones, so an update is only rejected for what it changes and not for pre-existing issues
+func getChangedControllerAnnotations(oldAnnotations, newAnnotations map[string]string) (changedKeys []string) {
+
+	changedKeys = []string{}
+
+	oldControllerAnnotations := getControllerAnnotations(oldAnnotations)
+	newControllerAnnotations := getControllerAnnotations(newAnnotations)
+
+	for key, value := range newControllerAnnotations {
+		if oldValue, ok := oldControllerAnnotations[key]; (!ok || oldValue != value) && !foundation.StringArrayContains(alwaysAdmittedAnnotations, key) {
+			changedKeys = append(changedKeys, key)
+		}
+	}
+	for key := range oldControllerAnnotations {
+		if _, ok := newControllerAnnotations[key]; !ok && !foundation.StringArrayContains(alwaysAdmittedAnnotations, key) {
+			changedKeys = append(changedKeys, key)
+		}
+	}
+
+	sort.Strings(changedKeys)
+
+	return
+}
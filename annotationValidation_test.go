@@ -0,0 +1,330 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateSecretAnnotations(t *testing.T) {
+	t.Run("ReturnsNoMessagesForValidAnnotations", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":                              "true",
+			"estafette.io/gcp-service-account-name":                         "my-application",
+			"estafette.io/gcp-service-account-filename":                     "key.json",
+			"estafette.io/gcp-service-account-permissions":                  `[{"project":"my-project","role":"roles/storage.objectViewer"}]`,
+			"estafette.io/gcp-service-account-derived-fields":               "true",
+			"estafette.io/gcp-service-account-templates":                    `{".boto":"{{.ClientEmail | json}}"}`,
+			"estafette.io/gcp-service-account-key-rotation-after-hours":     "24",
+			"estafette.io/gcp-service-account-maintenance-windows":          "Mon-Fri 09:00-17:00",
+			"estafette.io/gcp-service-account-maintenance-windows-timezone": "Europe/Amsterdam",
+			"estafette.io/gcp-service-account-state":                        `{"enabled":"true"}`,
+			"kubectl.kubernetes.io/last-applied-configuration":              "{}",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 0, len(messages))
+	})
+
+	t.Run("ReturnsNoMessagesIfControllerIsNotEnabled", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account": "false",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 0, len(messages))
+	})
+
+	t.Run("ReturnsMessageIfEnabledIsNotABoolean", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account": "yes please",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+	})
+
+	t.Run("ReturnsMessageIfNameIsMissing", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account": "true",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+		assert.Contains(t, messages[0], "is required")
+	})
+
+	t.Run("ReturnsMessageIfNameIsTooShort", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":      "true",
+			"estafette.io/gcp-service-account-name": "app",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+		assert.Contains(t, messages[0], "at least 5 characters")
+	})
+
+	t.Run("ReturnsMessageIfNameIsTooLong", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":      "true",
+			"estafette.io/gcp-service-account-name": "my-application-with-a-very-long-name-that-goes-on-and-on-and-on-and-on",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+		assert.Contains(t, messages[0], "at most 69 characters")
+	})
+
+	t.Run("ReturnsMessageIfNameHasUppercaseCharacters", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":      "true",
+			"estafette.io/gcp-service-account-name": "My-Application",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+	})
+
+	t.Run("ReturnsMessageIfPermissionsAreNotValidJSON", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":             "true",
+			"estafette.io/gcp-service-account-name":        "my-application",
+			"estafette.io/gcp-service-account-permissions": `[{"project":"my-project","role":"roles/storage.objectViewer"`,
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+		assert.Contains(t, messages[0], "estafette.io/gcp-service-account-permissions")
+	})
+
+	t.Run("ReturnsMessageIfPermissionHasNoRole", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":             "true",
+			"estafette.io/gcp-service-account-name":        "my-application",
+			"estafette.io/gcp-service-account-permissions": `[{"project":"my-project"}]`,
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+	})
+
+	t.Run("ReturnsMessageIfBooleanAnnotationIsNotABoolean", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":                "true",
+			"estafette.io/gcp-service-account-name":           "my-application",
+			"estafette.io/gcp-service-account-derived-fields": "yes",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+	})
+
+	t.Run("ReturnsMessageIfDisablingKeyRotationIsNotAllowed", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":                      "true",
+			"estafette.io/gcp-service-account-name":                 "my-application",
+			"estafette.io/gcp-service-account-disable-key-rotation": "true",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+		assert.Contains(t, messages[0], "not allowed")
+	})
+
+	t.Run("ReturnsMessageIfTemplateCannotBeParsed", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":           "true",
+			"estafette.io/gcp-service-account-name":      "my-application",
+			"estafette.io/gcp-service-account-templates": `{".boto":"{{.ClientEmail"}`,
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+	})
+
+	t.Run("ReturnsMessageIfTemplateOverwritesControllerEntry", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":           "true",
+			"estafette.io/gcp-service-account-name":      "my-application",
+			"estafette.io/gcp-service-account-filename":  "key.json",
+			"estafette.io/gcp-service-account-templates": `{"key.json.previous":"{{.ClientEmail}}","client_email":"{{.ClientEmail}}"}`,
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 2, len(messages))
+		assert.Contains(t, messages[0], "written by the controller")
+	})
+
+	t.Run("ReturnsMessageIfHoursAreNotPositive", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":                        "true",
+			"estafette.io/gcp-service-account-name":                   "my-application",
+			"estafette.io/gcp-service-account-purge-keys-after-hours": "-1",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+	})
+
+	t.Run("ReturnsOnlyMessagesForChangedKeys", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":                   "true",
+			"estafette.io/gcp-service-account-name":              "app",
+			"estafette.io/gcp-service-account-derived-fields":    "yes",
+			"estafette.io/gcp-service-account-keep-previous-key": "maybe",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, []string{"estafette.io/gcp-service-account-keep-previous-key"})
+
+		assert.Equal(t, 1, len(messages))
+		assert.Contains(t, messages[0], "keep-previous-key")
+	})
+
+	t.Run("ReturnsMessageForUnknownAnnotation", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":         "true",
+			"estafette.io/gcp-service-account-name":    "my-application",
+			"estafette.io/gcp-service-account-filname": "key.json",
+		}
+
+		// act
+		messages := validateSecretAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+		assert.Contains(t, messages[0], "unknown")
+	})
+}
+
+func TestValidateServiceAccountAnnotations(t *testing.T) {
+	t.Run("ReturnsNoMessagesForValidAnnotations", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":      "true",
+			"estafette.io/gcp-service-account-name": "my-application",
+		}
+
+		// act
+		messages := validateServiceAccountAnnotations(annotations, nil)
+
+		assert.Equal(t, 0, len(messages))
+	})
+
+	t.Run("ReturnsMessageForAnnotationOnlySupportedOnSecrets", func(t *testing.T) {
+
+		annotations := map[string]string{
+			"estafette.io/gcp-service-account":          "true",
+			"estafette.io/gcp-service-account-name":     "my-application",
+			"estafette.io/gcp-service-account-filename": "key.json",
+		}
+
+		// act
+		messages := validateServiceAccountAnnotations(annotations, nil)
+
+		assert.Equal(t, 1, len(messages))
+		assert.Contains(t, messages[0], "not supported on service accounts")
+	})
+}
+
+func TestGetChangedControllerAnnotations(t *testing.T) {
+	t.Run("ReturnsNoKeysIfOnlyStateChanged", func(t *testing.T) {
+
+		oldAnnotations := map[string]string{
+			"estafette.io/gcp-service-account":       "true",
+			"estafette.io/gcp-service-account-state": `{"lastAttempt":"2020-11-23T10:00:00Z"}`,
+		}
+		newAnnotations := map[string]string{
+			"estafette.io/gcp-service-account":       "true",
+			"estafette.io/gcp-service-account-state": `{"lastAttempt":"2020-11-23T11:00:00Z"}`,
+			"other-annotation":                       "value",
+		}
+
+		// act
+		changedKeys := getChangedControllerAnnotations(oldAnnotations, newAnnotations)
+
+		assert.Equal(t, 0, len(changedKeys))
+	})
+
+	t.Run("ReturnsNoKeysIfOnlyRevokeNowAndRotateNowChanged", func(t *testing.T) {
+
+		oldAnnotations := map[string]string{
+			"estafette.io/gcp-service-account":      "true",
+			"estafette.io/gcp-service-account-name": "app",
+		}
+		newAnnotations := map[string]string{
+			"estafette.io/gcp-service-account":            "true",
+			"estafette.io/gcp-service-account-name":       "app",
+			"estafette.io/gcp-service-account-revoke-now": "incident-1",
+			"estafette.io/gcp-service-account-rotate-now": "1",
+		}
+
+		// act
+		changedKeys := getChangedControllerAnnotations(oldAnnotations, newAnnotations)
+
+		assert.Equal(t, 0, len(changedKeys))
+	})
+
+	t.Run("ReturnsAddedChangedAndRemovedKeys", func(t *testing.T) {
+
+		oldAnnotations := map[string]string{
+			"estafette.io/gcp-service-account":          "true",
+			"estafette.io/gcp-service-account-name":     "my-application",
+			"estafette.io/gcp-service-account-filename": "key.json",
+		}
+		newAnnotations := map[string]string{
+			"estafette.io/gcp-service-account":                "true",
+			"estafette.io/gcp-service-account-name":           "my-other-application",
+			"estafette.io/gcp-service-account-derived-fields": "true",
+		}
+
+		// act
+		changedKeys := getChangedControllerAnnotations(oldAnnotations, newAnnotations)
+
+		assert.Equal(t, []string{"estafette.io/gcp-service-account-derived-fields", "estafette.io/gcp-service-account-filename", "estafette.io/gcp-service-account-name"}, changedKeys)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const eventSourceComponent string = "estafette-gcp-service-account"
+
+// getSecretObjectReference returns the reference to a secret to use as involved object for events
+func getSecretObjectReference(secret *v1.Secret) v1.ObjectReference {
+	return v1.ObjectReference{
+		Kind:            "Secret",
+		APIVersion:      "v1",
+		Namespace:       secret.Namespace,
+		Name:            secret.Name,
+		UID:             secret.UID,
+		ResourceVersion: secret.ResourceVersion,
+	}
+}
+
+// getServiceAccountObjectReference returns the reference to a kubernetes service account to use as involved object for events
+func getServiceAccountObjectReference(serviceAccount *v1.ServiceAccount) v1.ObjectReference {
+	return v1.ObjectReference{
+		Kind:            "ServiceAccount",
+		APIVersion:      "v1",
+		Namespace:       serviceAccount.Namespace,
+		Name:            serviceAccount.Name,
+		UID:             serviceAccount.UID,
+		ResourceVersion: serviceAccount.ResourceVersion,
+	}
+}
+
+// reportInvalidState logs, records an event and counts that an object isn't acted upon because its annotations (desired state) or stored state (current state) can't be parsed
+func reportInvalidState(kubeClientset *kubernetes.Clientset, involvedObject v1.ObjectReference, initiator, state string, err error) {
+
+	log.Error().Err(err).Msgf("[%v] %v %v.%v - Not acting on %v until its %v state is fixed", initiator, involvedObject.Kind, involvedObject.Name, involvedObject.Namespace, strings.ToLower(involvedObject.Kind), state)
+
+	reason := "InvalidAnnotations"
+	if state == "current" {
+		reason = "InvalidState"
+	}
+	_ = createEvent(kubeClientset, involvedObject, v1.EventTypeWarning, reason, fmt.Sprintf("Not acting on this %v until fixed: %v", strings.ToLower(involvedObject.Kind), err))
+
+	invalidStateTotals.With(prometheus.Labels{"namespace": involvedObject.Namespace, "initiator": initiator, "type": strings.ToLower(involvedObject.Kind), "state": state}).Inc()
+}
+
+// createEvent records an event for the involved object; repeated events with the same reason are aggregated into a single event by increasing its count
+func createEvent(kubeClientset *kubernetes.Clientset, involvedObject v1.ObjectReference, eventType, reason, message string) (err error) {
+
+	// use a predictable event name to be able to update an existing event instead of creating a new one each time
+	hash := fnv.New32a()
+	hash.Write([]byte(involvedObject.Kind + "/" + string(involvedObject.UID) + "/" + reason))
+	eventName := fmt.Sprintf("%v.%x", involvedObject.Name, hash.Sum32())
+
+	now := metav1.NewTime(time.Now())
+
+	event, err := kubeClientset.CoreV1().Events(involvedObject.Namespace).Get(context.Background(), eventName, metav1.GetOptions{})
+	if err == nil {
+		event.Count++
+		event.Message = message
+		event.LastTimestamp = now
+		event.InvolvedObject = involvedObject
+
+		_, err = kubeClientset.CoreV1().Events(involvedObject.Namespace).Update(context.Background(), event, metav1.UpdateOptions{})
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed updating event %v for %v %v.%v", reason, involvedObject.Kind, involvedObject.Name, involvedObject.Namespace)
+		}
+		return
+	}
+	if !errors.IsNotFound(err) {
+		log.Error().Err(err).Msgf("Failed retrieving event %v for %v %v.%v", reason, involvedObject.Kind, involvedObject.Name, involvedObject.Namespace)
+		return
+	}
+
+	_, err = kubeClientset.CoreV1().Events(involvedObject.Namespace).Create(context.Background(), &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      eventName,
+			Namespace: involvedObject.Namespace,
+		},
+		InvolvedObject: involvedObject,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source: v1.EventSource{
+			Component: eventSourceComponent,
+		},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed creating event %v for %v %v.%v", reason, involvedObject.Kind, involvedObject.Name, involvedObject.Namespace)
+	}
+
+	return
+}
@@ -1,28 +1,66 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"path"
 	"regexp"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	foundation "github.com/estafette/estafette-foundation"
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/storage/v1"
 )
 
+// ErrServiceAccountNotFound is returned when a service account managed by this controller has been deleted outside of the controller
+var ErrServiceAccountNotFound = errors.New("The service account does not exist")
+
+// ErrNoServiceAccountProjectCapacity is returned when all service account projects have reached the maximum number of service accounts
+var ErrNoServiceAccountProjectCapacity = errors.New("All service account projects have reached the maximum number of service accounts")
+
+// service account counts are refreshed from the iam api after this duration, in between they're kept up to date by the controller's own creates and deletes
+const serviceAccountCountRefreshInterval = 1 * time.Hour
+
 // GoogleCloudIAMService is the service that allows to create service accounts
 type GoogleCloudIAMService struct {
 	service                 *iam.Service
+	httpClient              *http.Client
+	storageService          *storage.Service
 	watcher                 *fsnotify.Watcher
 	serviceAccountProjectID string
 	localProjectID          string
+
+	// further projects to create service accounts in once the previous ones have reached maxServiceAccountsPerProject; service accounts are looked up and validated across all of them
+	serviceAccountProjectPool    []string
+	maxServiceAccountsPerProject int
+	serviceAccountCounts         map[string]serviceAccountCount
+	serviceAccountCountsMutex    sync.Mutex
+
+	// unique ids of the service accounts validated so far, to backfill the state of accounts created before the unique id was stored
+	uniqueIDs      map[string]string
+	uniqueIDsMutex sync.Mutex
+}
+
+// serviceAccountCount is the number of service accounts in a project as last listed and updated since
+type serviceAccountCount struct {
+	count    int
+	listedAt time.Time
 }
 
 // NewGoogleCloudIAMService returns an initialized GoogleCloudIAMService
-func NewGoogleCloudIAMService(serviceAccountProjectID, localProjectID string) (*GoogleCloudIAMService, error) {
+func NewGoogleCloudIAMService(serviceAccountProjectID string, serviceAccountProjectPool []string, maxServiceAccountsPerProject int, localProjectID string) (*GoogleCloudIAMService, error) {
 
 	if serviceAccountProjectID == "" {
 		return nil, fmt.Errorf("Parameter serviceAccountProjectID should not be empty")
@@ -42,15 +80,120 @@ func NewGoogleCloudIAMService(serviceAccountProjectID, localProjectID string) (*
 		return nil, err
 	}
 
+	storageService, err := storage.New(googleClient)
+	if err != nil {
+		return nil, err
+	}
+
 	return &GoogleCloudIAMService{
-		service:                 iamService,
-		serviceAccountProjectID: serviceAccountProjectID,
-		localProjectID:          localProjectID,
+		service:                      iamService,
+		httpClient:                   googleClient,
+		storageService:               storageService,
+		serviceAccountProjectID:      serviceAccountProjectID,
+		localProjectID:               localProjectID,
+		serviceAccountProjectPool:    serviceAccountProjectPool,
+		maxServiceAccountsPerProject: maxServiceAccountsPerProject,
+		serviceAccountCounts:         map[string]serviceAccountCount{},
+		uniqueIDs:                    map[string]string{},
 	}, nil
 }
 
+// getServiceAccountProjectIDs returns the service account project followed by the projects in its pool
+func (googleCloudIAMService *GoogleCloudIAMService) getServiceAccountProjectIDs() []string {
+	return append([]string{googleCloudIAMService.serviceAccountProjectID}, googleCloudIAMService.serviceAccountProjectPool...)
+}
+
+// ownsProject returns true if the project is the service account project or one of the projects in its pool
+func (googleCloudIAMService *GoogleCloudIAMService) ownsProject(projectID string) bool {
+	return foundation.StringArrayContains(googleCloudIAMService.getServiceAccountProjectIDs(), projectID)
+}
+
+// listServiceAccounts retrieves all service accounts in a project and records their number for tracking the project's capacity
+func (googleCloudIAMService *GoogleCloudIAMService) listServiceAccounts(projectID string) (serviceAccounts []*iam.ServiceAccount, err error) {
+
+	nextPageToken := ""
+
+	for {
+		// retrieving service accounts (by page)
+		log.Info().Msgf("Retrieving service accounts in project %v with page token '%v'...", projectID, nextPageToken)
+		listCall := googleCloudIAMService.service.Projects.ServiceAccounts.List("projects/" + projectID)
+		if nextPageToken != "" {
+			listCall.PageToken(nextPageToken)
+		}
+		resp, err := listCall.Context(context.Background()).Do()
+		if err != nil {
+			return nil, err
+		}
+
+		serviceAccounts = append(serviceAccounts, resp.Accounts...)
+
+		if resp.NextPageToken == "" {
+			break
+		}
+		nextPageToken = resp.NextPageToken
+	}
+
+	googleCloudIAMService.setServiceAccountCount(projectID, len(serviceAccounts), time.Now())
+
+	return serviceAccounts, nil
+}
+
+// setServiceAccountCount records the number of service accounts in a project as listed at the given time
+func (googleCloudIAMService *GoogleCloudIAMService) setServiceAccountCount(projectID string, count int, listedAt time.Time) {
+
+	googleCloudIAMService.serviceAccountCountsMutex.Lock()
+	defer googleCloudIAMService.serviceAccountCountsMutex.Unlock()
+
+	if googleCloudIAMService.serviceAccountCounts == nil {
+		googleCloudIAMService.serviceAccountCounts = map[string]serviceAccountCount{}
+	}
+	googleCloudIAMService.serviceAccountCounts[projectID] = serviceAccountCount{count: count, listedAt: listedAt}
+}
+
+// updateServiceAccountCount adds delta to the recorded number of service accounts in a project, if it has been listed before
+func (googleCloudIAMService *GoogleCloudIAMService) updateServiceAccountCount(projectID string, delta int) {
+
+	googleCloudIAMService.serviceAccountCountsMutex.Lock()
+	defer googleCloudIAMService.serviceAccountCountsMutex.Unlock()
+
+	if recorded, ok := googleCloudIAMService.serviceAccountCounts[projectID]; ok {
+		recorded.count += delta
+		googleCloudIAMService.serviceAccountCounts[projectID] = recorded
+	}
+}
+
+// getServiceAccountProjectWithCapacity returns the first project of the pool that hasn't reached the maximum number of service accounts, listing the projects whose count is unknown or outdated
+func (googleCloudIAMService *GoogleCloudIAMService) getServiceAccountProjectWithCapacity(now time.Time) (projectID string, err error) {
+
+	if googleCloudIAMService.maxServiceAccountsPerProject <= 0 {
+		return googleCloudIAMService.serviceAccountProjectID, nil
+	}
+
+	for _, projectID := range googleCloudIAMService.getServiceAccountProjectIDs() {
+		googleCloudIAMService.serviceAccountCountsMutex.Lock()
+		recorded, ok := googleCloudIAMService.serviceAccountCounts[projectID]
+		googleCloudIAMService.serviceAccountCountsMutex.Unlock()
+
+		if !ok || now.Sub(recorded.listedAt) > serviceAccountCountRefreshInterval {
+			serviceAccounts, err := googleCloudIAMService.listServiceAccounts(projectID)
+			if err != nil {
+				return "", err
+			}
+			recorded.count = len(serviceAccounts)
+		}
+
+		if recorded.count < googleCloudIAMService.maxServiceAccountsPerProject {
+			return projectID, nil
+		}
+
+		log.Debug().Msgf("Project %v has %v service accounts, which is at or over the maximum of %v", projectID, recorded.count, googleCloudIAMService.maxServiceAccountsPerProject)
+	}
+
+	return "", ErrNoServiceAccountProjectCapacity
+}
+
 // CreateServiceAccount creates a service account
-func (googleCloudIAMService *GoogleCloudIAMService) CreateServiceAccount(name string) (fullServiceAccountName string, err error) {
+func (googleCloudIAMService *GoogleCloudIAMService) CreateServiceAccount(name string) (fullServiceAccountName, uniqueID string, err error) {
 
 	// generate random account id and structured display name to serve as 'metadata'
 	accountID, displayName, err := googleCloudIAMService.getServiceAccountIDAndDisplayName(name)
@@ -58,9 +201,15 @@ func (googleCloudIAMService *GoogleCloudIAMService) CreateServiceAccount(name st
 		return
 	}
 
+	// pick the first project of the pool with room for another service account
+	projectID, err := googleCloudIAMService.getServiceAccountProjectWithCapacity(time.Now())
+	if err != nil {
+		return
+	}
+
 	// ensure account doesn't already exist
 	for {
-		serviceAccount, _ := googleCloudIAMService.service.Projects.ServiceAccounts.Get("projects/" + googleCloudIAMService.serviceAccountProjectID + "/serviceAccounts/" + accountID).Context(context.Background()).Do()
+		serviceAccount, _ := googleCloudIAMService.service.Projects.ServiceAccounts.Get("projects/" + projectID + "/serviceAccounts/" + accountID).Context(context.Background()).Do()
 
 		// if the service account doesn't exist, it's free to create a new one with this account id
 		if serviceAccount == nil {
@@ -75,7 +224,7 @@ func (googleCloudIAMService *GoogleCloudIAMService) CreateServiceAccount(name st
 	}
 
 	// create the service account
-	serviceAccount, err := googleCloudIAMService.service.Projects.ServiceAccounts.Create("projects/"+googleCloudIAMService.serviceAccountProjectID, &iam.CreateServiceAccountRequest{
+	serviceAccount, err := googleCloudIAMService.service.Projects.ServiceAccounts.Create("projects/"+projectID, &iam.CreateServiceAccountRequest{
 		AccountId: accountID,
 		ServiceAccount: &iam.ServiceAccount{
 			DisplayName: displayName,
@@ -85,13 +234,16 @@ func (googleCloudIAMService *GoogleCloudIAMService) CreateServiceAccount(name st
 		return
 	}
 
+	googleCloudIAMService.updateServiceAccountCount(projectID, 1)
+
 	fullServiceAccountName = serviceAccount.Name
+	uniqueID = serviceAccount.UniqueId
 
 	return
 }
 
 // GetServiceAccountByDisplayName retrieves the full service account name based on the display name format '<local project id>/serviceAccountName'
-func (googleCloudIAMService *GoogleCloudIAMService) GetServiceAccountByDisplayName(name string) (fullServiceAccountName string, fullServiceAccountEmail string, err error) {
+func (googleCloudIAMService *GoogleCloudIAMService) GetServiceAccountByDisplayName(name string) (fullServiceAccountName, fullServiceAccountEmail, uniqueID string, err error) {
 
 	// generate structured display name to be able to retrieve the service account with random account id
 	_, displayName, err := googleCloudIAMService.getServiceAccountIDAndDisplayName(name)
@@ -100,32 +252,21 @@ func (googleCloudIAMService *GoogleCloudIAMService) GetServiceAccountByDisplayNa
 	}
 
 	matchingServiceAccounts := []*iam.ServiceAccount{}
-	nextPageToken := ""
 
-	for {
-		// retrieving service accounts (by page)
-		log.Info().Msgf("Retrieving service accounts with page token '%v'...", nextPageToken)
-		listCall := googleCloudIAMService.service.Projects.ServiceAccounts.List("projects/" + googleCloudIAMService.serviceAccountProjectID)
-		if nextPageToken != "" {
-			listCall.PageToken(nextPageToken)
-		}
-		resp, err := listCall.Context(context.Background()).Do()
+	// the service account can be in any of the projects of the pool
+	for _, projectID := range googleCloudIAMService.getServiceAccountProjectIDs() {
+		serviceAccounts, err := googleCloudIAMService.listServiceAccounts(projectID)
 		if err != nil {
-			return "", "", err
+			return "", "", "", err
 		}
 
 		// filter on display names
-		log.Info().Msgf("Checking %v service accounts for matching display name...", len(resp.Accounts))
-		for _, sa := range resp.Accounts {
+		log.Info().Msgf("Checking %v service accounts in project %v for matching display name...", len(serviceAccounts), projectID)
+		for _, sa := range serviceAccounts {
 			if sa.DisplayName == displayName {
 				matchingServiceAccounts = append(matchingServiceAccounts, sa)
 			}
 		}
-
-		if resp.NextPageToken == "" {
-			break
-		}
-		nextPageToken = resp.NextPageToken
 	}
 
 	log.Info().Msgf("Found %v service accounts with matching display name...", len(matchingServiceAccounts))
@@ -138,11 +279,12 @@ func (googleCloudIAMService *GoogleCloudIAMService) GetServiceAccountByDisplayNa
 		// pick service account with highest unique id
 		fullServiceAccountName = matchingServiceAccounts[0].Name
 		fullServiceAccountEmail = matchingServiceAccounts[0].Email
+		uniqueID = matchingServiceAccounts[0].UniqueId
 
 		return
 	}
 
-	return "", "", fmt.Errorf("There is no service account with display name %v in project %v", displayName, googleCloudIAMService.serviceAccountProjectID)
+	return "", "", "", fmt.Errorf("There is no service account with display name %v in projects %v", displayName, strings.Join(googleCloudIAMService.getServiceAccountProjectIDs(), ", "))
 }
 
 // GetServiceAccountIDAndDisplayName generates account id and display name if mode is set to normal or convenient
@@ -175,8 +317,8 @@ func (googleCloudIAMService *GoogleCloudIAMService) getServiceAccountIDAndDispla
 // CreateServiceAccountKey creates a key file for an existing account
 func (googleCloudIAMService *GoogleCloudIAMService) CreateServiceAccountKey(fullServiceAccountName string) (serviceAccountKey *iam.ServiceAccountKey, err error) {
 
-	if !googleCloudIAMService.validateServiceAccount(fullServiceAccountName) {
-		return nil, fmt.Errorf("The service account is not valid for this controller to create keys for")
+	if err = googleCloudIAMService.validateServiceAccount(fullServiceAccountName, "create keys for"); err != nil {
+		return nil, err
 	}
 
 	serviceAccountKey, err = googleCloudIAMService.service.Projects.ServiceAccounts.Keys.Create(fullServiceAccountName, &iam.CreateServiceAccountKeyRequest{}).Context(context.Background()).Do()
@@ -187,14 +329,35 @@ func (googleCloudIAMService *GoogleCloudIAMService) CreateServiceAccountKey(full
 	return
 }
 
-// listServiceAccountKeys lists all keys for an existing account
+// GetServiceAccountPublicKey returns the pem encoded x509 certificate holding the public key for a key of an existing account
+func (googleCloudIAMService *GoogleCloudIAMService) GetServiceAccountPublicKey(keyName string) (publicKeyPEM []byte, err error) {
+
+	// the public key isn't always available immediately after creating a key
+	var serviceAccountKey *iam.ServiceAccountKey
+	for attempt := 1; attempt <= 5; attempt++ {
+		serviceAccountKey, err = googleCloudIAMService.service.Projects.ServiceAccounts.Keys.Get(keyName).PublicKeyType("TYPE_X509_PEM_FILE").Context(context.Background()).Do()
+		if err == nil {
+			break
+		}
+		log.Debug().Err(err).Msgf("Retrieving public key for key %v failed, retrying...", keyName)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	if err != nil {
+		return
+	}
+
+	return base64.StdEncoding.DecodeString(serviceAccountKey.PublicKeyData)
+}
+
+// listServiceAccountKeys lists all user-managed keys for an existing account
 func (googleCloudIAMService *GoogleCloudIAMService) listServiceAccountKeys(fullServiceAccountName string) (serviceAccountKeys []*iam.ServiceAccountKey, err error) {
 
-	if !googleCloudIAMService.validateServiceAccount(fullServiceAccountName) {
-		return nil, fmt.Errorf("The service account is not valid for this controller to list keys for")
+	if err = googleCloudIAMService.validateServiceAccount(fullServiceAccountName, "list keys for"); err != nil {
+		return nil, err
 	}
 
-	keyListResponse, err := googleCloudIAMService.service.Projects.ServiceAccounts.Keys.List(fullServiceAccountName).Context(context.Background()).Do()
+	// system-managed keys are rotated by google itself and should never be touched
+	keyListResponse, err := googleCloudIAMService.service.Projects.ServiceAccounts.Keys.List(fullServiceAccountName).KeyTypes("USER_MANAGED").Context(context.Background()).Do()
 	if err != nil {
 		return
 	}
@@ -204,53 +367,357 @@ func (googleCloudIAMService *GoogleCloudIAMService) listServiceAccountKeys(fullS
 	return
 }
 
-// PurgeServiceAccountKeys purges all keys older than x hours for an existing account
-func (googleCloudIAMService *GoogleCloudIAMService) PurgeServiceAccountKeys(fullServiceAccountName string, purgeKeysAfterHours int) (deleteCount int, err error) {
+// EvictOldestServiceAccountKey deletes a key issued by this controller to make room for a new key when the account has reached its limit of user-managed keys; disabled keys go first, then keys old enough to be purged and then the oldest other key, while the newest issued key and the protected keys are never evicted
+func (googleCloudIAMService *GoogleCloudIAMService) EvictOldestServiceAccountKey(fullServiceAccountName string, issuedKeyIDs, protectedKeyIDs []string, disabledKeys map[string]string, purgeKeysAfterHours int) (evictedKeyID string, err error) {
 
 	serviceAccountKeys, err := googleCloudIAMService.listServiceAccountKeys(fullServiceAccountName)
 	if err != nil {
 		return
 	}
 
-	if len(serviceAccountKeys) > 1 {
-		// reverse sort with newest first
-		sort.Slice(serviceAccountKeys, func(i, j int) bool {
-			return serviceAccountKeys[i].ValidAfterTime > serviceAccountKeys[j].ValidAfterTime
-		})
+	issuedKeys := []*iam.ServiceAccountKey{}
+	for _, key := range serviceAccountKeys {
+		if foundation.StringArrayContains(issuedKeyIDs, getKeyID(key.Name)) {
+			issuedKeys = append(issuedKeys, key)
+		}
+	}
 
-		// check all but the newest to see if it's old enough to be purged
-		for _, key := range serviceAccountKeys[1:] {
+	key := getKeyToEvict(issuedKeys, protectedKeyIDs, disabledKeys, purgeKeysAfterHours, time.Now())
+	if key == nil {
+		return "", fmt.Errorf("Service account %v has no keys issued by this controller that can be evicted", fullServiceAccountName)
+	}
 
-			// parse validAfterTime to get key creation date
-			keyCreatedAt := time.Time{}
-			if key.ValidAfterTime == "" {
-				log.Warn().Msgf("Key %v has empty ValidAfterTime, skipping...", key.Name)
-				continue
-			}
+	log.Info().Msgf("Evicting key %v created at %v because the service account has reached its key limit...", key.Name, key.ValidAfterTime)
+	_, err = googleCloudIAMService.deleteServiceAccountKey(key)
+	if err != nil {
+		return
+	}
+
+	return getKeyID(key.Name), nil
+}
+
+// getKeyToEvict returns the issued key that can be evicted with the least impact, or nil if every key is either the newest or protected
+func getKeyToEvict(issuedKeys []*iam.ServiceAccountKey, protectedKeyIDs []string, disabledKeys map[string]string, purgeKeysAfterHours int, now time.Time) *iam.ServiceAccountKey {
+
+	if len(issuedKeys) < 2 {
+		return nil
+	}
+
+	// sort with oldest first
+	sortedKeys := append([]*iam.ServiceAccountKey{}, issuedKeys...)
+	sort.Slice(sortedKeys, func(i, j int) bool {
+		return sortedKeys[i].ValidAfterTime < sortedKeys[j].ValidAfterTime
+	})
+
+	// all but the newest key that aren't protected
+	candidates := []*iam.ServiceAccountKey{}
+	for _, key := range sortedKeys[:len(sortedKeys)-1] {
+		if !foundation.StringArrayContains(protectedKeyIDs, getKeyID(key.Name)) {
+			candidates = append(candidates, key)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// disabled keys aren't used by anyone anymore
+	for _, key := range candidates {
+		if _, disabled := disabledKeys[getKeyID(key.Name)]; disabled {
+			return key
+		}
+	}
+
+	// keys old enough to be purged would be disabled soon anyway
+	if purgeEligibleKeys := getPurgeEligibleKeys(sortedKeys, protectedKeyIDs, purgeKeysAfterHours, now); len(purgeEligibleKeys) > 0 {
+		return purgeEligibleKeys[len(purgeEligibleKeys)-1]
+	}
+
+	return candidates[0]
+}
+
+// DeleteAllServiceAccountKeys deletes all user-managed keys for an existing account, for revoking leaked keys
+func (googleCloudIAMService *GoogleCloudIAMService) DeleteAllServiceAccountKeys(fullServiceAccountName string) (deletedKeyIDs []string, err error) {
+
+	serviceAccountKeys, err := googleCloudIAMService.listServiceAccountKeys(fullServiceAccountName)
+	if err != nil {
+		return
+	}
+
+	// keep deleting the other keys if one fails, so as few revoked keys as possible stay valid
+	failures := []string{}
+	for _, key := range serviceAccountKeys {
+		log.Info().Msgf("Deleting key %v created at %v because all keys are being revoked...", key.Name, key.ValidAfterTime)
+		_, deleteErr := googleCloudIAMService.deleteServiceAccountKey(key)
+		if deleteErr != nil && !isNotFoundError(deleteErr) {
+			log.Error().Err(deleteErr).Msgf("Failed deleting key %v", key.Name)
+			failures = append(failures, fmt.Sprintf("%v: %v", getKeyID(key.Name), deleteErr))
+			continue
+		}
+		deletedKeyIDs = append(deletedKeyIDs, getKeyID(key.Name))
+	}
+
+	if len(failures) > 0 {
+		return deletedKeyIDs, fmt.Errorf("Deleting %v of %v keys failed: %v", len(failures), len(serviceAccountKeys), strings.Join(failures, "; "))
+	}
+
+	return deletedKeyIDs, nil
+}
+
+// isKeyLimitError returns true if the google api refused to create a key because the account has reached its limit of user-managed keys
+func isKeyLimitError(err error) bool {
+	if apiError, ok := err.(*googleapi.Error); ok {
+		return apiError.Code == http.StatusBadRequest && strings.Contains(strings.ToLower(apiError.Message), "precondition")
+	}
+
+	return false
+}
+
+// ServiceAccountKeyPurgeResult contains the outcome of purging keys for a service account
+type ServiceAccountKeyPurgeResult struct {
+	DisableCount  int
+	DeleteCount   int
+	ActiveKeyIDs  []string
+	IssuedKeyIDs  []string
+	UnknownKeyIDs []string
+	DisabledKeys  map[string]string
+}
+
+// getPurgeEligibleKeys returns the issued keys that are old enough to be disabled or deleted; the newest issued key and the retained keys never are
+func getPurgeEligibleKeys(issuedKeys []*iam.ServiceAccountKey, retainedKeyIDs []string, purgeKeysAfterHours int, now time.Time) (eligibleKeys []*iam.ServiceAccountKey) {
+
+	if len(issuedKeys) < 2 {
+		return
+	}
+
+	// reverse sort with newest first
+	sortedKeys := append([]*iam.ServiceAccountKey{}, issuedKeys...)
+	sort.Slice(sortedKeys, func(i, j int) bool {
+		return sortedKeys[i].ValidAfterTime > sortedKeys[j].ValidAfterTime
+	})
+
+	// check all but the newest to see if it's old enough to be purged
+	for _, key := range sortedKeys[1:] {
 
-			keyCreatedAt, err = time.Parse(time.RFC3339, key.ValidAfterTime)
+		if foundation.StringArrayContains(retainedKeyIDs, getKeyID(key.Name)) {
+			log.Info().Msgf("Key %v is retained, skipping...", key.Name)
+			continue
+		}
+
+		// parse validAfterTime to get key creation date
+		if key.ValidAfterTime == "" {
+			log.Warn().Msgf("Key %v has empty ValidAfterTime, skipping...", key.Name)
+			continue
+		}
+
+		keyCreatedAt, err := time.Parse(time.RFC3339, key.ValidAfterTime)
+		if err != nil {
+			log.Warn().Msgf("Can't parse ValidAfterTime %v for key %v, skipping...", key.ValidAfterTime, key.Name)
+			continue
+		}
+
+		// check if it's old enough to purge
+		if now.Sub(keyCreatedAt).Hours() <= float64(purgeKeysAfterHours) {
+			continue
+		}
+
+		eligibleKeys = append(eligibleKeys, key)
+	}
+
+	return
+}
+
+// HasPurgeEligibleKeys returns true if any key issued by this controller is old enough to be disabled or deleted
+func (googleCloudIAMService *GoogleCloudIAMService) HasPurgeEligibleKeys(fullServiceAccountName string, purgeKeysAfterHours int, issuedKeyIDs, retainedKeyIDs []string) (hasEligibleKeys bool, err error) {
+
+	serviceAccountKeys, err := googleCloudIAMService.listServiceAccountKeys(fullServiceAccountName)
+	if err != nil {
+		return
+	}
+
+	issuedKeys := []*iam.ServiceAccountKey{}
+	for _, key := range serviceAccountKeys {
+		if foundation.StringArrayContains(issuedKeyIDs, getKeyID(key.Name)) {
+			issuedKeys = append(issuedKeys, key)
+		}
+	}
+
+	return len(getPurgeEligibleKeys(issuedKeys, retainedKeyIDs, purgeKeysAfterHours, time.Now())) > 0, nil
+}
+
+// PurgeServiceAccountKeys retires all keys issued by this controller older than x hours for an existing account; keys are disabled first and only deleted once they've been disabled for the observation window without being re-enabled; keys not issued by this controller are left alone and reported as unknown
+func (googleCloudIAMService *GoogleCloudIAMService) PurgeServiceAccountKeys(fullServiceAccountName string, purgeKeysAfterHours, disableKeysObservationHours int, issuedKeyIDs, retainedKeyIDs []string, disabledKeys map[string]string) (result ServiceAccountKeyPurgeResult, err error) {
+
+	serviceAccountKeys, err := googleCloudIAMService.listServiceAccountKeys(fullServiceAccountName)
+	if err != nil {
+		return
+	}
+
+	// only keys issued by this controller are candidates for purging
+	issuedKeys := []*iam.ServiceAccountKey{}
+	for _, key := range serviceAccountKeys {
+		if foundation.StringArrayContains(issuedKeyIDs, getKeyID(key.Name)) {
+			issuedKeys = append(issuedKeys, key)
+		} else {
+			log.Warn().Msgf("Key %v has not been issued by this controller, skipping...", key.Name)
+			result.UnknownKeyIDs = append(result.UnknownKeyIDs, getKeyID(key.Name))
+		}
+	}
+
+	// carry over disabled keys that still exist
+	result.DisabledKeys = map[string]string{}
+	for _, key := range issuedKeys {
+		if disabledAt, ok := disabledKeys[getKeyID(key.Name)]; ok {
+			result.DisabledKeys[getKeyID(key.Name)] = disabledAt
+		}
+	}
+
+	deletedKeyNames := map[string]bool{}
+	for _, key := range getPurgeEligibleKeys(issuedKeys, retainedKeyIDs, purgeKeysAfterHours, time.Now()) {
+		keyID := getKeyID(key.Name)
+
+		// first disable the key, so it can be re-enabled if a consumer turns out to still use it
+		disabledAtString, disabled := result.DisabledKeys[keyID]
+		if !disabled {
+			log.Info().Msgf("Disabling key %v created at %v because it is more than %v hours old...", key.Name, key.ValidAfterTime, purgeKeysAfterHours)
+			err := googleCloudIAMService.disableServiceAccountKey(key.Name)
 			if err != nil {
-				log.Warn().Msgf("Can't parse ValidAfterTime %v for key %v, skipping...", key.ValidAfterTime, key.Name)
+				log.Error().Err(err).Msgf("Failed disabling key %v", key.Name)
 				continue
 			}
+			result.DisableCount++
+			result.DisabledKeys[keyID] = time.Now().Format(time.RFC3339)
+			continue
+		}
 
-			// check if it's old enough to purge
-			if time.Since(keyCreatedAt).Hours() > float64(purgeKeysAfterHours) {
-				log.Info().Msgf("Deleting key %v created at %v (parsed to %v) because it is more than %v hours old...", key.Name, key.ValidAfterTime, keyCreatedAt, purgeKeysAfterHours)
-				deleted, err := googleCloudIAMService.deleteServiceAccountKey(key)
-				if err != nil {
-					log.Error().Err(err).Msgf("Failed deleting key %v", key.Name)
-					continue
-				} else if deleted {
-					deleteCount++
-				}
-			}
+		// only delete the key once it has been disabled for the observation window
+		disabledAt, err := time.Parse(time.RFC3339, disabledAtString)
+		if err == nil && time.Since(disabledAt).Hours() <= float64(disableKeysObservationHours) {
+			continue
+		}
+
+		log.Info().Msgf("Deleting key %v disabled at %v because it is more than %v hours ago...", key.Name, disabledAtString, disableKeysObservationHours)
+		deleted, err := googleCloudIAMService.deleteServiceAccountKey(key)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed deleting key %v", key.Name)
+			continue
+		} else if deleted {
+			result.DeleteCount++
+			deletedKeyNames[key.Name] = true
+			delete(result.DisabledKeys, keyID)
+		}
+	}
+
+	for _, key := range serviceAccountKeys {
+		if _, disabled := result.DisabledKeys[getKeyID(key.Name)]; !deletedKeyNames[key.Name] && !disabled {
+			result.ActiveKeyIDs = append(result.ActiveKeyIDs, getKeyID(key.Name))
+		}
+	}
+	for _, key := range issuedKeys {
+		if !deletedKeyNames[key.Name] {
+			result.IssuedKeyIDs = append(result.IssuedKeyIDs, getKeyID(key.Name))
 		}
 	}
 
 	return
 }
 
+// disableServiceAccountKey disables a key, so it can no longer be used to authenticate but can still be enabled again
+func (googleCloudIAMService *GoogleCloudIAMService) disableServiceAccountKey(keyName string) (err error) {
+	log.Debug().Msgf("Disabling key %v...", keyName)
+	return googleCloudIAMService.postServiceAccountKeyMethod(keyName, "disable")
+}
+
+// EnableServiceAccountKey enables a previously disabled key for an existing account
+func (googleCloudIAMService *GoogleCloudIAMService) EnableServiceAccountKey(fullServiceAccountName, keyID string) (err error) {
+
+	if err = googleCloudIAMService.validateServiceAccount(fullServiceAccountName, "enable keys for"); err != nil {
+		return err
+	}
+
+	keyName := fullServiceAccountName + "/keys/" + keyID
+
+	log.Debug().Msgf("Enabling key %v...", keyName)
+	return googleCloudIAMService.postServiceAccountKeyMethod(keyName, "enable")
+}
+
+// postServiceAccountKeyMethod calls a custom method on a key that isn't available in the generated iam client yet
+func (googleCloudIAMService *GoogleCloudIAMService) postServiceAccountKeyMethod(keyName, method string) (err error) {
+
+	url := googleapi.ResolveRelative(googleCloudIAMService.service.BasePath, "v1/"+keyName+":"+method)
+	request, err := http.NewRequest("POST", url, bytes.NewBufferString("{}"))
+	if err != nil {
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := googleCloudIAMService.httpClient.Do(request.WithContext(context.Background()))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	return googleapi.CheckResponse(resp)
+}
+
+// GetServiceAccountKeyStatus returns whether a key of an existing account still exists and whether it has been disabled, also when that has been done outside of this controller
+func (googleCloudIAMService *GoogleCloudIAMService) GetServiceAccountKeyStatus(fullServiceAccountName, keyID string) (exists, disabled bool, err error) {
+
+	if err = googleCloudIAMService.validateServiceAccount(fullServiceAccountName, "get keys for"); err != nil {
+		return
+	}
+
+	// the disabled field isn't available in the generated iam client yet
+	url := googleapi.ResolveRelative(googleCloudIAMService.service.BasePath, "v1/"+fullServiceAccountName+"/keys/"+keyID)
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+
+	resp, err := googleCloudIAMService.httpClient.Do(request.WithContext(context.Background()))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	err = googleapi.CheckResponse(resp)
+	if err != nil {
+		if isNotFoundError(err) {
+			return false, false, nil
+		}
+		return
+	}
+
+	var serviceAccountKey struct {
+		Disabled bool `json:"disabled"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&serviceAccountKey)
+	if err != nil {
+		return
+	}
+
+	return true, serviceAccountKey.Disabled, nil
+}
+
+// GetServiceAccountKeyCreatedAt returns when a key of an existing account has been created, for writing outputs derived from a key that has been issued before
+func (googleCloudIAMService *GoogleCloudIAMService) GetServiceAccountKeyCreatedAt(fullServiceAccountName, keyID string) (createdAt string, err error) {
+
+	if err = googleCloudIAMService.validateServiceAccount(fullServiceAccountName, "get keys for"); err != nil {
+		return
+	}
+
+	serviceAccountKey, err := googleCloudIAMService.service.Projects.ServiceAccounts.Keys.Get(fullServiceAccountName + "/keys/" + keyID).Context(context.Background()).Do()
+	if err != nil {
+		return
+	}
+
+	return serviceAccountKey.ValidAfterTime, nil
+}
+
+// getKeyID returns the key id - as used in the private_key_id field of a keyfile - from the full key name
+func getKeyID(keyName string) string {
+	return path.Base(keyName)
+}
+
 // deleteServiceAccountKey deletes a key file for an existing account
 func (googleCloudIAMService *GoogleCloudIAMService) deleteServiceAccountKey(serviceAccountKey *iam.ServiceAccountKey) (deleted bool, err error) {
 
@@ -267,11 +734,192 @@ func (googleCloudIAMService *GoogleCloudIAMService) deleteServiceAccountKey(serv
 	return
 }
 
+// CreateHmacKey creates a hmac key for an existing account, for use by S3-compatible clients
+func (googleCloudIAMService *GoogleCloudIAMService) CreateHmacKey(fullServiceAccountName string) (accessID, secret string, err error) {
+
+	if err = googleCloudIAMService.validateServiceAccount(fullServiceAccountName, "create hmac keys for"); err != nil {
+		return "", "", err
+	}
+
+	projectID, serviceAccountEmail, err := getProjectIDAndServiceAccountEmail(fullServiceAccountName)
+	if err != nil {
+		return
+	}
+
+	hmacKey, err := googleCloudIAMService.storageService.Projects.HmacKeys.Create(projectID, serviceAccountEmail).Context(context.Background()).Do()
+	if err != nil {
+		return
+	}
+
+	return hmacKey.Metadata.AccessId, hmacKey.Secret, nil
+}
+
+// listHmacKeys lists all active and inactive hmac keys for an existing account
+func (googleCloudIAMService *GoogleCloudIAMService) listHmacKeys(fullServiceAccountName string) (hmacKeys []*storage.HmacKeyMetadata, err error) {
+
+	if err = googleCloudIAMService.validateServiceAccount(fullServiceAccountName, "list hmac keys for"); err != nil {
+		return nil, err
+	}
+
+	projectID, serviceAccountEmail, err := getProjectIDAndServiceAccountEmail(fullServiceAccountName)
+	if err != nil {
+		return
+	}
+
+	err = googleCloudIAMService.storageService.Projects.HmacKeys.List(projectID).ServiceAccountEmail(serviceAccountEmail).ShowDeletedKeys(false).Pages(context.Background(), func(resp *storage.HmacKeysMetadata) error {
+		hmacKeys = append(hmacKeys, resp.Items...)
+		return nil
+	})
+
+	return
+}
+
+// getPurgeEligibleHmacKeys returns the hmac keys issued by this controller that are old enough to be purged, never the one currently stored in the secret
+func getPurgeEligibleHmacKeys(hmacKeys []*storage.HmacKeyMetadata, issuedAccessIDs []string, currentAccessID string, purgeKeysAfterHours int, now time.Time) (eligibleKeys []*storage.HmacKeyMetadata) {
+
+	for _, key := range hmacKeys {
+
+		if key.AccessId == currentAccessID || !foundation.StringArrayContains(issuedAccessIDs, key.AccessId) {
+			continue
+		}
+
+		keyCreatedAt, err := time.Parse(time.RFC3339, key.TimeCreated)
+		if err != nil {
+			log.Warn().Msgf("Can't parse TimeCreated %v for hmac key %v, skipping...", key.TimeCreated, key.AccessId)
+			continue
+		}
+
+		// check if it's old enough to purge
+		if now.Sub(keyCreatedAt).Hours() <= float64(purgeKeysAfterHours) {
+			continue
+		}
+
+		eligibleKeys = append(eligibleKeys, key)
+	}
+
+	return
+}
+
+// PurgeHmacKeys deactivates and deletes the hmac keys issued by this controller that are older than x hours, except the one currently stored in the secret; it returns the issued access ids that still exist
+func (googleCloudIAMService *GoogleCloudIAMService) PurgeHmacKeys(fullServiceAccountName string, purgeKeysAfterHours int, issuedAccessIDs []string, currentAccessID string) (remainingAccessIDs []string, deleteCount int, err error) {
+
+	hmacKeys, err := googleCloudIAMService.listHmacKeys(fullServiceAccountName)
+	if err != nil {
+		return issuedAccessIDs, 0, err
+	}
+
+	deletedAccessIDs := []string{}
+	for _, key := range getPurgeEligibleHmacKeys(hmacKeys, issuedAccessIDs, currentAccessID, purgeKeysAfterHours, time.Now()) {
+		log.Info().Msgf("Deleting hmac key %v created at %v because it is more than %v hours old...", key.AccessId, key.TimeCreated, purgeKeysAfterHours)
+		err := googleCloudIAMService.deleteHmacKey(key)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed deleting hmac key %v", key.AccessId)
+			continue
+		}
+		deletedAccessIDs = append(deletedAccessIDs, key.AccessId)
+		deleteCount++
+	}
+
+	// forget access ids that have been deleted, either now or outside of this controller
+	for _, key := range hmacKeys {
+		if foundation.StringArrayContains(issuedAccessIDs, key.AccessId) && !foundation.StringArrayContains(deletedAccessIDs, key.AccessId) {
+			remainingAccessIDs = append(remainingAccessIDs, key.AccessId)
+		}
+	}
+
+	return remainingAccessIDs, deleteCount, nil
+}
+
+// DeleteHmacKey deactivates and deletes a single hmac key of an existing account
+func (googleCloudIAMService *GoogleCloudIAMService) DeleteHmacKey(fullServiceAccountName, accessID string) (err error) {
+
+	if err = googleCloudIAMService.validateServiceAccount(fullServiceAccountName, "delete hmac keys for"); err != nil {
+		return err
+	}
+
+	projectID, _, err := getProjectIDAndServiceAccountEmail(fullServiceAccountName)
+	if err != nil {
+		return
+	}
+
+	hmacKey, err := googleCloudIAMService.storageService.Projects.HmacKeys.Get(projectID, accessID).Context(context.Background()).Do()
+	if err != nil {
+		return
+	}
+
+	return googleCloudIAMService.deleteHmacKey(hmacKey)
+}
+
+// DeleteAllHmacKeys deactivates and deletes all hmac keys for an existing account, for revoking leaked keys
+func (googleCloudIAMService *GoogleCloudIAMService) DeleteAllHmacKeys(fullServiceAccountName string) (deleteCount int, err error) {
+
+	hmacKeys, err := googleCloudIAMService.listHmacKeys(fullServiceAccountName)
+	if err != nil {
+		return
+	}
+
+	// keep deleting the other keys if one fails, so as few revoked keys as possible stay valid
+	failures := []string{}
+	for _, key := range hmacKeys {
+		log.Info().Msgf("Deleting hmac key %v created at %v because all keys are being revoked...", key.AccessId, key.TimeCreated)
+		deleteErr := googleCloudIAMService.deleteHmacKey(key)
+		if deleteErr != nil {
+			log.Error().Err(deleteErr).Msgf("Failed deleting hmac key %v", key.AccessId)
+			failures = append(failures, fmt.Sprintf("%v: %v", key.AccessId, deleteErr))
+			continue
+		}
+		deleteCount++
+	}
+
+	if len(failures) > 0 {
+		return deleteCount, fmt.Errorf("Deleting %v of %v hmac keys failed: %v", len(failures), len(hmacKeys), strings.Join(failures, "; "))
+	}
+
+	return deleteCount, nil
+}
+
+// deleteHmacKey deactivates a hmac key if needed and then deletes it, because only inactive keys can be deleted
+func (googleCloudIAMService *GoogleCloudIAMService) deleteHmacKey(hmacKey *storage.HmacKeyMetadata) (err error) {
+
+	if hmacKey.State == "ACTIVE" {
+		log.Debug().Msgf("Deactivating hmac key %v...", hmacKey.AccessId)
+		_, err = googleCloudIAMService.storageService.Projects.HmacKeys.Update(hmacKey.ProjectId, hmacKey.AccessId, &storage.HmacKeyMetadata{
+			State: "INACTIVE",
+			Etag:  hmacKey.Etag,
+		}).Context(context.Background()).Do()
+		if err != nil {
+			return
+		}
+	}
+
+	log.Debug().Msgf("Deleting hmac key %v...", hmacKey.AccessId)
+	return googleCloudIAMService.storageService.Projects.HmacKeys.Delete(hmacKey.ProjectId, hmacKey.AccessId).Context(context.Background()).Do()
+}
+
+// UndeleteServiceAccount restores a service account deleted less than 30 days ago by its unique id
+func (googleCloudIAMService *GoogleCloudIAMService) UndeleteServiceAccount(uniqueID string) (fullServiceAccountName string, err error) {
+
+	resp, err := googleCloudIAMService.service.Projects.ServiceAccounts.Undelete("projects/-/serviceAccounts/"+uniqueID, &iam.UndeleteServiceAccountRequest{}).Context(context.Background()).Do()
+	if err != nil {
+		return
+	}
+
+	if resp.RestoredAccount == nil {
+		return "", fmt.Errorf("Undeleting service account %v didn't return the restored account", uniqueID)
+	}
+
+	if !googleCloudIAMService.validateFullServiceAccountName(resp.RestoredAccount.Name) || !googleCloudIAMService.validateDisplayName(resp.RestoredAccount.DisplayName) {
+		return "", fmt.Errorf("The restored service account %v is not valid for this controller", resp.RestoredAccount.Name)
+	}
+
+	return resp.RestoredAccount.Name, nil
+}
+
 // DeleteServiceAccount deletes a service account
 func (googleCloudIAMService *GoogleCloudIAMService) DeleteServiceAccount(fullServiceAccountName string) (deleted bool, err error) {
 
-	if !googleCloudIAMService.validateServiceAccount(fullServiceAccountName) {
-		return false, fmt.Errorf("The service account is not valid for this controller to delete")
+	if err = googleCloudIAMService.validateServiceAccount(fullServiceAccountName, "delete"); err != nil {
+		return false, err
 	}
 
 	resp, err := googleCloudIAMService.service.Projects.ServiceAccounts.Delete(fullServiceAccountName).Context(context.Background()).Do()
@@ -281,32 +929,71 @@ func (googleCloudIAMService *GoogleCloudIAMService) DeleteServiceAccount(fullSer
 
 	if resp.HTTPStatusCode == 200 {
 		deleted = true
+
+		if projectID, _, err := getProjectIDAndServiceAccountEmail(fullServiceAccountName); err == nil {
+			googleCloudIAMService.updateServiceAccountCount(projectID, -1)
+		}
 	}
 
 	return
 }
 
-// validateFullServiceAccountName validates whether this controller is allowed to do anything with the service account
-func (googleCloudIAMService *GoogleCloudIAMService) validateServiceAccount(fullServiceAccountName string) (valid bool) {
+// validateServiceAccount validates whether this controller is allowed to do anything with the service account; it returns ErrServiceAccountNotFound if the service account has been deleted
+func (googleCloudIAMService *GoogleCloudIAMService) validateServiceAccount(fullServiceAccountName, action string) (err error) {
 
 	if !googleCloudIAMService.validateFullServiceAccountName(fullServiceAccountName) {
-		return false
+		return fmt.Errorf("The service account is not valid for this controller to %v", action)
 	}
 
 	serviceAccount, err := googleCloudIAMService.service.Projects.ServiceAccounts.Get(fullServiceAccountName).Context(context.Background()).Do()
 	if err != nil {
-		return false
+		if isNotFoundError(err) {
+			return ErrServiceAccountNotFound
+		}
+		return fmt.Errorf("The service account is not valid for this controller to %v: %v", action, err)
 	}
 
-	if serviceAccount == nil {
-		return false
+	if serviceAccount == nil || !googleCloudIAMService.validateDisplayName(serviceAccount.DisplayName) {
+		return fmt.Errorf("The service account is not valid for this controller to %v", action)
 	}
 
-	if !googleCloudIAMService.validateDisplayName(serviceAccount.DisplayName) {
-		return false
+	googleCloudIAMService.setUniqueID(fullServiceAccountName, serviceAccount.UniqueId)
+
+	return nil
+}
+
+// setUniqueID remembers the unique id of a validated service account
+func (googleCloudIAMService *GoogleCloudIAMService) setUniqueID(fullServiceAccountName, uniqueID string) {
+
+	if uniqueID == "" {
+		return
 	}
 
-	return true
+	googleCloudIAMService.uniqueIDsMutex.Lock()
+	defer googleCloudIAMService.uniqueIDsMutex.Unlock()
+
+	if googleCloudIAMService.uniqueIDs == nil {
+		googleCloudIAMService.uniqueIDs = map[string]string{}
+	}
+	googleCloudIAMService.uniqueIDs[fullServiceAccountName] = uniqueID
+}
+
+// GetKnownUniqueID returns the unique id of a service account this service has validated, or an empty string if it hasn't done so yet
+func (googleCloudIAMService *GoogleCloudIAMService) GetKnownUniqueID(fullServiceAccountName string) string {
+
+	googleCloudIAMService.uniqueIDsMutex.Lock()
+	defer googleCloudIAMService.uniqueIDsMutex.Unlock()
+
+	return googleCloudIAMService.uniqueIDs[fullServiceAccountName]
+}
+
+// isNotFoundError returns true if the google api returned a 404
+func isNotFoundError(err error) bool {
+	if apiError, ok := err.(*googleapi.Error); ok {
+		return apiError.Code == http.StatusNotFound
+	}
+
+	return false
 }
 
 // validateFullServiceAccountName validates whether this controller is allowed to do anything with the service account
@@ -321,19 +1008,32 @@ func (googleCloudIAMService *GoogleCloudIAMService) validateFullServiceAccountNa
 		return false
 	}
 
-	if matches[1] != googleCloudIAMService.serviceAccountProjectID {
-		log.Warn().Msgf("Project '%v' in full service account '%v' doesn't match project '%v' as set for this controller", matches[1], fullServiceAccountName, googleCloudIAMService.serviceAccountProjectID)
+	if !googleCloudIAMService.ownsProject(matches[1]) {
+		log.Warn().Msgf("Project '%v' in full service account '%v' doesn't match projects '%v' as set for this controller", matches[1], fullServiceAccountName, strings.Join(googleCloudIAMService.getServiceAccountProjectIDs(), ", "))
 		return false
 	}
 
-	if matches[3] != googleCloudIAMService.serviceAccountProjectID {
-		log.Warn().Msgf("Project '%v' in service account email '%v@%v.%v' doesn't match project '%v' as set for this controller", matches[3], matches[2], matches[3], matches[4], googleCloudIAMService.serviceAccountProjectID)
+	if matches[3] != matches[1] {
+		log.Warn().Msgf("Project '%v' in service account email '%v@%v.%v' doesn't match project '%v' of the full service account name", matches[3], matches[2], matches[3], matches[4], matches[1])
 		return false
 	}
 
 	return true
 }
 
+// getProjectIDAndServiceAccountEmail splits the full service account name in the project id and the service account email
+func getProjectIDAndServiceAccountEmail(fullServiceAccountName string) (projectID, serviceAccountEmail string, err error) {
+
+	r, _ := regexp.Compile(`^projects/([^/]+)/serviceAccounts/([^/]+@[^/]+)$`)
+
+	matches := r.FindStringSubmatch(fullServiceAccountName)
+	if len(matches) != 3 {
+		return "", "", fmt.Errorf("Full service account name '%v' doesn't have a valid structure", fullServiceAccountName)
+	}
+
+	return matches[1], matches[2], nil
+}
+
 // validateDisplayName validates whether this controller is allowed to do anything with the service account
 func (googleCloudIAMService *GoogleCloudIAMService) validateDisplayName(displayName string) (valid bool) {
 
@@ -357,8 +1057,8 @@ func (googleCloudIAMService *GoogleCloudIAMService) validateDisplayName(displayN
 // SetServiceAccountRoleBinding sets the desired permissions for this service account
 func (googleCloudIAMService *GoogleCloudIAMService) SetServiceAccountRoleBinding(fullServiceAccountName string, permissions []GCPServiceAccountPermission) (err error) {
 
-	if !googleCloudIAMService.validateServiceAccount(fullServiceAccountName) {
-		return fmt.Errorf("The service account is not valid for this controller to modify roles for")
+	if err = googleCloudIAMService.validateServiceAccount(fullServiceAccountName, "modify roles for"); err != nil {
+		return err
 	}
 
 	// get current iam policies for service account
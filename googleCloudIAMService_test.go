@@ -1,10 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+	iam "google.golang.org/api/iam/v1"
+	storage "google.golang.org/api/storage/v1"
 )
 
 func TestValidateFullServiceAccountName(t *testing.T) {
@@ -59,6 +64,109 @@ func TestValidateFullServiceAccountName(t *testing.T) {
 
 		assert.False(t, valid)
 	})
+
+	t.Run("ReturnsTrueIfProjectIsInPool", func(t *testing.T) {
+
+		service := &GoogleCloudIAMService{
+			serviceAccountProjectID:   "my-service-account-container",
+			serviceAccountProjectPool: []string{"my-service-account-container-2"},
+			localProjectID:            "my-dev-project",
+		}
+
+		// act
+		valid := service.validateFullServiceAccountName("projects/my-service-account-container-2/serviceAccounts/dev-my-service-account-asdi@my-service-account-container-2.iam.gserviceaccount.com")
+
+		assert.True(t, valid)
+	})
+
+	t.Run("ReturnsFalseIfProjectInEmailDoesNotMatchPoolProject", func(t *testing.T) {
+
+		service := &GoogleCloudIAMService{
+			serviceAccountProjectID:   "my-service-account-container",
+			serviceAccountProjectPool: []string{"my-service-account-container-2"},
+			localProjectID:            "my-dev-project",
+		}
+
+		// act
+		valid := service.validateFullServiceAccountName("projects/my-service-account-container-2/serviceAccounts/dev-my-service-account-asdi@my-service-account-container.iam.gserviceaccount.com")
+
+		assert.False(t, valid)
+	})
+}
+
+func TestGetServiceAccountProjectWithCapacity(t *testing.T) {
+	t.Run("ReturnsServiceAccountProjectIfThereIsNoMaximum", func(t *testing.T) {
+
+		service := &GoogleCloudIAMService{
+			serviceAccountProjectID:   "my-service-account-container",
+			serviceAccountProjectPool: []string{"my-service-account-container-2"},
+		}
+
+		// act
+		projectID, err := service.getServiceAccountProjectWithCapacity(time.Now())
+
+		assert.Nil(t, err)
+		assert.Equal(t, "my-service-account-container", projectID)
+	})
+
+	t.Run("ReturnsFirstProjectBelowMaximum", func(t *testing.T) {
+
+		now := time.Now()
+		service := &GoogleCloudIAMService{
+			serviceAccountProjectID:      "my-service-account-container",
+			serviceAccountProjectPool:    []string{"my-service-account-container-2", "my-service-account-container-3"},
+			maxServiceAccountsPerProject: 100,
+			serviceAccountCounts: map[string]serviceAccountCount{
+				"my-service-account-container":   {count: 100, listedAt: now},
+				"my-service-account-container-2": {count: 99, listedAt: now},
+				"my-service-account-container-3": {count: 0, listedAt: now},
+			},
+		}
+
+		// act
+		projectID, err := service.getServiceAccountProjectWithCapacity(now)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "my-service-account-container-2", projectID)
+	})
+
+	t.Run("ReturnsErrorIfAllProjectsAreAtMaximum", func(t *testing.T) {
+
+		now := time.Now()
+		service := &GoogleCloudIAMService{
+			serviceAccountProjectID:      "my-service-account-container",
+			serviceAccountProjectPool:    []string{"my-service-account-container-2"},
+			maxServiceAccountsPerProject: 100,
+			serviceAccountCounts: map[string]serviceAccountCount{
+				"my-service-account-container":   {count: 100, listedAt: now},
+				"my-service-account-container-2": {count: 100, listedAt: now},
+			},
+		}
+
+		// act
+		_, err := service.getServiceAccountProjectWithCapacity(now)
+
+		assert.Equal(t, ErrNoServiceAccountProjectCapacity, err)
+	})
+
+	t.Run("ReturnsProjectAfterCountIsLoweredByDelete", func(t *testing.T) {
+
+		now := time.Now()
+		service := &GoogleCloudIAMService{
+			serviceAccountProjectID:      "my-service-account-container",
+			maxServiceAccountsPerProject: 100,
+			serviceAccountCounts: map[string]serviceAccountCount{
+				"my-service-account-container": {count: 100, listedAt: now},
+			},
+		}
+		service.updateServiceAccountCount("my-service-account-container", -1)
+
+		// act
+		projectID, err := service.getServiceAccountProjectWithCapacity(now)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "my-service-account-container", projectID)
+	})
 }
 
 func TestValidateDisplayName(t *testing.T) {
@@ -189,3 +297,217 @@ func TestGetServiceAccountIDAndDisplayName(t *testing.T) {
 		assert.Equal(t, 29, len(displayName))
 	})
 }
+
+func TestGetProjectIDAndServiceAccountEmail(t *testing.T) {
+	t.Run("ReturnsProjectIDAndEmailFromFullServiceAccountName", func(t *testing.T) {
+
+		// act
+		projectID, serviceAccountEmail, err := getProjectIDAndServiceAccountEmail("projects/my-service-account-container/serviceAccounts/dev-my-service-account-asdi@my-service-account-container.iam.gserviceaccount.com")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "my-service-account-container", projectID)
+		assert.Equal(t, "dev-my-service-account-asdi@my-service-account-container.iam.gserviceaccount.com", serviceAccountEmail)
+	})
+
+	t.Run("ReturnsErrorIfFullServiceAccountNameDoesNotMatchURL", func(t *testing.T) {
+
+		// act
+		_, _, err := getProjectIDAndServiceAccountEmail("organization/my-service-account-container/serviceAccounts/dev-my-service-account-asdi@my-service-account-container.iam.gserviceaccount.com")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestGetKeyID(t *testing.T) {
+	t.Run("ReturnsLastSegmentOfKeyName", func(t *testing.T) {
+
+		// act
+		keyID := getKeyID("projects/my-service-account-container/serviceAccounts/dev-my-service-account-asdi@my-service-account-container.iam.gserviceaccount.com/keys/0123456789abcdef")
+
+		assert.Equal(t, "0123456789abcdef", keyID)
+	})
+}
+
+func TestIsKeyLimitError(t *testing.T) {
+	t.Run("ReturnsTrueForFailedPreconditionError", func(t *testing.T) {
+
+		// act
+		isKeyLimit := isKeyLimitError(&googleapi.Error{Code: 400, Message: "Precondition check failed."})
+
+		assert.True(t, isKeyLimit)
+	})
+
+	t.Run("ReturnsFalseForOtherBadRequestErrors", func(t *testing.T) {
+
+		// act
+		isKeyLimit := isKeyLimitError(&googleapi.Error{Code: 400, Message: "Invalid argument."})
+
+		assert.False(t, isKeyLimit)
+	})
+
+	t.Run("ReturnsFalseForNonGoogleAPIErrors", func(t *testing.T) {
+
+		// act
+		isKeyLimit := isKeyLimitError(fmt.Errorf("Precondition check failed."))
+
+		assert.False(t, isKeyLimit)
+	})
+}
+
+func TestGetKnownUniqueID(t *testing.T) {
+	t.Run("ReturnsUniqueIDOfValidatedServiceAccount", func(t *testing.T) {
+
+		service := &GoogleCloudIAMService{}
+		service.setUniqueID("projects/my-project/serviceAccounts/my-app@my-project.iam.gserviceaccount.com", "1234567890")
+
+		// act
+		uniqueID := service.GetKnownUniqueID("projects/my-project/serviceAccounts/my-app@my-project.iam.gserviceaccount.com")
+
+		assert.Equal(t, "1234567890", uniqueID)
+	})
+
+	t.Run("ReturnsEmptyStringForServiceAccountThatHasNotBeenValidated", func(t *testing.T) {
+
+		service := &GoogleCloudIAMService{}
+
+		// act
+		uniqueID := service.GetKnownUniqueID("projects/my-project/serviceAccounts/my-app@my-project.iam.gserviceaccount.com")
+
+		assert.Equal(t, "", uniqueID)
+	})
+}
+
+func TestGetPurgeEligibleKeys(t *testing.T) {
+
+	now := time.Date(2020, 11, 23, 10, 0, 0, 0, time.UTC)
+	keyName := func(keyID string) string {
+		return "projects/my-project/serviceAccounts/my-app@my-project.iam.gserviceaccount.com/keys/" + keyID
+	}
+	issuedKeys := []*iam.ServiceAccountKey{
+		{Name: keyName("newest"), ValidAfterTime: now.Add(-1 * time.Hour).Format(time.RFC3339)},
+		{Name: keyName("recent"), ValidAfterTime: now.Add(-2 * time.Hour).Format(time.RFC3339)},
+		{Name: keyName("old"), ValidAfterTime: now.Add(-48 * time.Hour).Format(time.RFC3339)},
+		{Name: keyName("oldest"), ValidAfterTime: now.Add(-72 * time.Hour).Format(time.RFC3339)},
+	}
+
+	t.Run("ReturnsKeysOlderThanPurgeKeysAfterHours", func(t *testing.T) {
+
+		// act
+		eligibleKeys := getPurgeEligibleKeys(issuedKeys, []string{}, 24, now)
+
+		if assert.Equal(t, 2, len(eligibleKeys)) {
+			assert.Equal(t, "old", getKeyID(eligibleKeys[0].Name))
+			assert.Equal(t, "oldest", getKeyID(eligibleKeys[1].Name))
+		}
+	})
+
+	t.Run("ReturnsNoRetainedKeys", func(t *testing.T) {
+
+		// act
+		eligibleKeys := getPurgeEligibleKeys(issuedKeys, []string{"old"}, 24, now)
+
+		if assert.Equal(t, 1, len(eligibleKeys)) {
+			assert.Equal(t, "oldest", getKeyID(eligibleKeys[0].Name))
+		}
+	})
+
+	t.Run("ReturnsNoKeysIfOnlyTheNewestKeyIsOldEnough", func(t *testing.T) {
+
+		// act
+		eligibleKeys := getPurgeEligibleKeys(issuedKeys[2:3], []string{}, 24, now)
+
+		assert.Equal(t, 0, len(eligibleKeys))
+	})
+}
+
+func TestGetKeyToEvict(t *testing.T) {
+
+	now := time.Date(2020, 11, 23, 10, 0, 0, 0, time.UTC)
+	keyName := func(keyID string) string {
+		return "projects/my-project/serviceAccounts/my-app@my-project.iam.gserviceaccount.com/keys/" + keyID
+	}
+	issuedKeys := []*iam.ServiceAccountKey{
+		{Name: keyName("newest"), ValidAfterTime: now.Add(-1 * time.Hour).Format(time.RFC3339)},
+		{Name: keyName("recent"), ValidAfterTime: now.Add(-2 * time.Hour).Format(time.RFC3339)},
+		{Name: keyName("old"), ValidAfterTime: now.Add(-48 * time.Hour).Format(time.RFC3339)},
+		{Name: keyName("oldest"), ValidAfterTime: now.Add(-72 * time.Hour).Format(time.RFC3339)},
+	}
+
+	t.Run("ReturnsDisabledKeyFirst", func(t *testing.T) {
+
+		// act
+		key := getKeyToEvict(issuedKeys, []string{}, map[string]string{"recent": "2020-11-23T09:00:00Z"}, 24, now)
+
+		if assert.NotNil(t, key) {
+			assert.Equal(t, "recent", getKeyID(key.Name))
+		}
+	})
+
+	t.Run("ReturnsOldestPurgeEligibleKeyIfNoKeyIsDisabled", func(t *testing.T) {
+
+		// act
+		key := getKeyToEvict(issuedKeys, []string{}, map[string]string{}, 24, now)
+
+		if assert.NotNil(t, key) {
+			assert.Equal(t, "oldest", getKeyID(key.Name))
+		}
+	})
+
+	t.Run("ReturnsNoProtectedKeys", func(t *testing.T) {
+
+		// act
+		key := getKeyToEvict(issuedKeys, []string{"oldest", "old"}, map[string]string{}, 24, now)
+
+		if assert.NotNil(t, key) {
+			assert.Equal(t, "recent", getKeyID(key.Name))
+		}
+	})
+
+	t.Run("ReturnsNilIfOnlyTheNewestKeyIsNotProtected", func(t *testing.T) {
+
+		// act
+		key := getKeyToEvict(issuedKeys, []string{"oldest", "old", "recent"}, map[string]string{}, 24, now)
+
+		assert.Nil(t, key)
+	})
+}
+
+func TestGetPurgeEligibleHmacKeys(t *testing.T) {
+
+	now := time.Date(2020, 11, 23, 10, 0, 0, 0, time.UTC)
+	hmacKeys := []*storage.HmacKeyMetadata{
+		{AccessId: "unstored", TimeCreated: now.Add(-1 * time.Hour).Format(time.RFC3339)},
+		{AccessId: "stored", TimeCreated: now.Add(-48 * time.Hour).Format(time.RFC3339)},
+		{AccessId: "old", TimeCreated: now.Add(-72 * time.Hour).Format(time.RFC3339)},
+		{AccessId: "not-issued", TimeCreated: now.Add(-96 * time.Hour).Format(time.RFC3339)},
+	}
+
+	t.Run("ReturnsIssuedKeysOlderThanPurgeKeysAfterHours", func(t *testing.T) {
+
+		// act
+		eligibleKeys := getPurgeEligibleHmacKeys(hmacKeys, []string{"unstored", "stored", "old"}, "", 24, now)
+
+		if assert.Equal(t, 2, len(eligibleKeys)) {
+			assert.Equal(t, "stored", eligibleKeys[0].AccessId)
+			assert.Equal(t, "old", eligibleKeys[1].AccessId)
+		}
+	})
+
+	t.Run("ReturnsNoKeyStoredInTheSecretEvenIfANewerKeyExists", func(t *testing.T) {
+
+		// act
+		eligibleKeys := getPurgeEligibleHmacKeys(hmacKeys, []string{"unstored", "stored", "old"}, "stored", 24, now)
+
+		if assert.Equal(t, 1, len(eligibleKeys)) {
+			assert.Equal(t, "old", eligibleKeys[0].AccessId)
+		}
+	})
+
+	t.Run("ReturnsNoKeysNotIssuedByThisController", func(t *testing.T) {
+
+		// act
+		eligibleKeys := getPurgeEligibleHmacKeys(hmacKeys, []string{}, "", 24, now)
+
+		assert.Equal(t, 0, len(eligibleKeys))
+	})
+}
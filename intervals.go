@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// getNamespaceAnnotations returns the annotations of a namespace; if the namespace can't be retrieved an error is returned instead of falling back to the controller's settings, since that would lift the namespace's restrictions
+func getNamespaceAnnotations(kubeClientset *kubernetes.Clientset, namespace string) (annotations map[string]string, err error) {
+
+	ns, err := kubeClientset.CoreV1().Namespaces().Get(context.Background(), namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed retrieving namespace %v: %v", namespace, err)
+	}
+
+	if ns.ObjectMeta.Annotations == nil {
+		return map[string]string{}, nil
+	}
+
+	return ns.ObjectMeta.Annotations, nil
+}
+
+// getEffectiveHours returns the hours set on the secret, or else on its namespace, or else the controller default, bounded by the controller minimum and maximum; a minimum or maximum of 0 means no bound
+func getEffectiveHours(secretHours int, namespaceAnnotations map[string]string, annotation string, defaultHours, minHours, maxHours int) (hours int) {
+
+	hours = defaultHours
+	if namespaceValue, ok := namespaceAnnotations[annotation]; ok {
+		if namespaceHours, err := strconv.Atoi(namespaceValue); err == nil && namespaceHours > 0 {
+			hours = namespaceHours
+		}
+	}
+	if secretHours > 0 {
+		hours = secretHours
+	}
+
+	if minHours > 0 && hours < minHours {
+		hours = minHours
+	}
+	if maxHours > 0 && hours > maxHours {
+		hours = maxHours
+	}
+
+	return
+}
+
+// applyEffectiveIntervals sets the rotation and purge intervals on the desired state, taking secret and namespace overrides and controller bounds into account
+func applyEffectiveIntervals(desiredState *GCPServiceAccountState, namespaceAnnotations map[string]string) {
+	desiredState.KeyRotationAfterHours = getEffectiveHours(desiredState.KeyRotationAfterHours, namespaceAnnotations, annotationGCPServiceAccountKeyRotationAfterHours, *keyRotationAfterHours, *minKeyRotationAfterHours, *maxKeyRotationAfterHours)
+	desiredState.PurgeKeysAfterHours = getEffectiveHours(desiredState.PurgeKeysAfterHours, namespaceAnnotations, annotationGCPServiceAccountPurgeKeysAfterHours, *purgeKeysAfterHours, *minPurgeKeysAfterHours, *maxPurgeKeysAfterHours)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetEffectiveHours(t *testing.T) {
+	t.Run("ReturnsDefaultIfNotOverridden", func(t *testing.T) {
+
+		// act
+		hours := getEffectiveHours(0, map[string]string{}, annotationGCPServiceAccountKeyRotationAfterHours, 168, 0, 0)
+
+		assert.Equal(t, 168, hours)
+	})
+
+	t.Run("ReturnsNamespaceValueIfSecretDoesNotOverride", func(t *testing.T) {
+
+		namespaceAnnotations := map[string]string{
+			annotationGCPServiceAccountKeyRotationAfterHours: "720",
+		}
+
+		// act
+		hours := getEffectiveHours(0, namespaceAnnotations, annotationGCPServiceAccountKeyRotationAfterHours, 168, 0, 0)
+
+		assert.Equal(t, 720, hours)
+	})
+
+	t.Run("ReturnsSecretValueOverNamespaceValue", func(t *testing.T) {
+
+		namespaceAnnotations := map[string]string{
+			annotationGCPServiceAccountKeyRotationAfterHours: "720",
+		}
+
+		// act
+		hours := getEffectiveHours(24, namespaceAnnotations, annotationGCPServiceAccountKeyRotationAfterHours, 168, 0, 0)
+
+		assert.Equal(t, 24, hours)
+	})
+
+	t.Run("IgnoresInvalidNamespaceValue", func(t *testing.T) {
+
+		namespaceAnnotations := map[string]string{
+			annotationGCPServiceAccountKeyRotationAfterHours: "monthly",
+		}
+
+		// act
+		hours := getEffectiveHours(0, namespaceAnnotations, annotationGCPServiceAccountKeyRotationAfterHours, 168, 0, 0)
+
+		assert.Equal(t, 168, hours)
+	})
+
+	t.Run("ReturnsMinimumIfValueIsLower", func(t *testing.T) {
+
+		// act
+		hours := getEffectiveHours(1, map[string]string{}, annotationGCPServiceAccountKeyRotationAfterHours, 168, 12, 720)
+
+		assert.Equal(t, 12, hours)
+	})
+
+	t.Run("ReturnsMaximumIfValueIsHigher", func(t *testing.T) {
+
+		// act
+		hours := getEffectiveHours(8760, map[string]string{}, annotationGCPServiceAccountKeyRotationAfterHours, 168, 12, 720)
+
+		assert.Equal(t, 720, hours)
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,35 +20,82 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"github.com/sethgrid/pester"
+	"google.golang.org/api/iam/v1"
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
-	annotationGCPServiceAccount                   string = "estafette.io/gcp-service-account"
-	annotationGCPServiceAccountName               string = "estafette.io/gcp-service-account-name"
-	annotationGCPServiceAccountFilename           string = "estafette.io/gcp-service-account-filename"
-	annotationGCPServiceAccountDisableKeyRotation string = "estafette.io/gcp-service-account-disable-key-rotation"
-	annotationGCPServiceAccountPermissions        string = "estafette.io/gcp-service-account-permissions"
-	annotationGCPServiceAccountState              string = "estafette.io/gcp-service-account-state"
+	annotationGCPServiceAccount                           string = "estafette.io/gcp-service-account"
+	annotationGCPServiceAccountName                       string = "estafette.io/gcp-service-account-name"
+	annotationGCPServiceAccountFilename                   string = "estafette.io/gcp-service-account-filename"
+	annotationGCPServiceAccountDisableKeyRotation         string = "estafette.io/gcp-service-account-disable-key-rotation"
+	annotationGCPServiceAccountPermissions                string = "estafette.io/gcp-service-account-permissions"
+	annotationGCPServiceAccountDerivedFields              string = "estafette.io/gcp-service-account-derived-fields"
+	annotationGCPServiceAccountTemplates                  string = "estafette.io/gcp-service-account-templates"
+	annotationGCPServiceAccountDockerRegistries           string = "estafette.io/gcp-service-account-docker-registries"
+	annotationGCPServiceAccountHmacKeys                   string = "estafette.io/gcp-service-account-hmac-keys"
+	annotationGCPServiceAccountKeepPreviousKey            string = "estafette.io/gcp-service-account-keep-previous-key"
+	annotationGCPServiceAccountReenableKeys               string = "estafette.io/gcp-service-account-reenable-keys"
+	annotationGCPServiceAccountRevokeNow                  string = "estafette.io/gcp-service-account-revoke-now"
+	annotationGCPServiceAccountRotateNow                  string = "estafette.io/gcp-service-account-rotate-now"
+	annotationGCPServiceAccountKeyRotationAfterHours      string = "estafette.io/gcp-service-account-key-rotation-after-hours"
+	annotationGCPServiceAccountPurgeKeysAfterHours        string = "estafette.io/gcp-service-account-purge-keys-after-hours"
+	annotationGCPServiceAccountMaintenanceWindows         string = "estafette.io/gcp-service-account-maintenance-windows"
+	annotationGCPServiceAccountMaintenanceWindowsTimezone string = "estafette.io/gcp-service-account-maintenance-windows-timezone"
+	annotationGCPServiceAccountRestartWorkloads           string = "estafette.io/gcp-service-account-restart-workloads"
+	annotationGCPServiceAccountConsumerAwarePurge         string = "estafette.io/gcp-service-account-consumer-aware-purge"
+	annotationGCPServiceAccountState                      string = "estafette.io/gcp-service-account-state"
 
 	annotationWorkloadIdentity string = "iam.gke.io/gcp-service-account"
 )
 
 // GCPServiceAccountState represents the state of the secret with respect to GCP service accounts
 type GCPServiceAccountState struct {
-	Enabled                 string                        `json:"enabled"`
-	Name                    string                        `json:"name"`
-	Filename                string                        `json:"filename,omitempty"`
-	DisableKeyRotation      bool                          `json:"disableKeyRotation"`
-	FullServiceAccountName  string                        `json:"fullServiceAccountName"`
-	FullServiceAccountEmail string                        `json:"fullServiceAccountEmail"`
-	Permissions             []GCPServiceAccountPermission `json:"permissions,omitempty"`
-	LastRenewed             string                        `json:"lastRenewed"`
-	LastAttempt             string                        `json:"lastAttempt"`
+	Enabled                    string                        `json:"enabled"`
+	Name                       string                        `json:"name"`
+	Filename                   string                        `json:"filename,omitempty"`
+	DisableKeyRotation         bool                          `json:"disableKeyRotation"`
+	DerivedFields              bool                          `json:"derivedFields,omitempty"`
+	Templates                  map[string]string             `json:"-"`
+	TemplateKeys               []string                      `json:"templateKeys,omitempty"`
+	TemplatesChecksum          string                        `json:"templatesChecksum,omitempty"`
+	DockerRegistries           []string                      `json:"dockerRegistries,omitempty"`
+	HmacKeys                   bool                          `json:"hmacKeys,omitempty"`
+	HmacAccessID               string                        `json:"hmacAccessId,omitempty"`
+	IssuedHmacAccessIDs        []string                      `json:"issuedHmacAccessIds,omitempty"`
+	KeepPreviousKey            bool                          `json:"keepPreviousKey,omitempty"`
+	ActiveKeyIDs               []string                      `json:"activeKeyIds,omitempty"`
+	IssuedKeyIDs               []string                      `json:"issuedKeyIds,omitempty"`
+	UnknownKeyIDs              []string                      `json:"unknownKeyIds,omitempty"`
+	DisabledKeys               map[string]string             `json:"disabledKeys,omitempty"`
+	ReenableKeyIDs             []string                      `json:"-"`
+	RevokeNowToken             string                        `json:"-"`
+	Revocations                []GCPServiceAccountRevocation `json:"revocations,omitempty"`
+	RotateNowToken             string                        `json:"-"`
+	ServedRotateNowToken       string                        `json:"servedRotateNowToken,omitempty"`
+	KeyRotationAfterHours      int                           `json:"-"`
+	PurgeKeysAfterHours        int                           `json:"-"`
+	MaintenanceWindows         string                        `json:"-"`
+	MaintenanceWindowsTimezone string                        `json:"-"`
+	RestartWorkloads           bool                          `json:"-"`
+	ConsumerAwarePurge         bool                          `json:"-"`
+	ServiceAccountProjectID    string                        `json:"-"`
+	KeysDisabled               bool                          `json:"-"`
+	WorkloadIdentityOnly       bool                          `json:"-"`
+	PolicyViolations           []string                      `json:"-"`
+	FullServiceAccountName     string                        `json:"fullServiceAccountName"`
+	FullServiceAccountEmail    string                        `json:"fullServiceAccountEmail"`
+	UniqueID                   string                        `json:"uniqueId,omitempty"`
+	Permissions                []GCPServiceAccountPermission `json:"permissions,omitempty"`
+	LastRenewed                string                        `json:"lastRenewed"`
+	LastAttempt                string                        `json:"lastAttempt"`
 }
 
 // GCPServiceAccountPermission represents a permission for a service account
@@ -57,12 +105,56 @@ type GCPServiceAccountPermission struct {
 }
 
 var (
+	controllerCommand = kingpin.Command("controller", "Runs the controller managing GCP service accounts for annotated secrets and service accounts.").Default()
+	revokeCommand     = kingpin.Command("revoke", "Revokes all keys for the service account managed by a secret and immediately issues a new key into the secret.")
+	revokeNamespace   = revokeCommand.Flag("namespace", "The namespace of the secret.").Required().String()
+	revokeSecretName  = revokeCommand.Flag("secret", "The name of the secret.").Required().String()
+	revokeKubeconfig  = revokeCommand.Flag("kubeconfig", "The kubeconfig file to use when not running inside the cluster.").Default(clientcmd.RecommendedHomeFile).Envar("KUBECONFIG").String()
+
 	mode                            = kingpin.Flag("mode", "The mode this controller can run in.").Default("normal").Envar("MODE").Enum("normal", "convenient", "rotate_keys_only")
-	serviceAccountProjectID         = kingpin.Flag("service-account-project-id", "The Google Cloud project id in which to create service accounts.").Envar("SERVICE_ACCOUNT_PROJECT_ID").Required().String()
-	keyRotationAfterHours           = kingpin.Flag("key-rotation-after-hours", "How many hours before a key is rotated.").Envar("KEY_ROTATION_AFTER_HOURS").Required().Int()
-	purgeKeysAfterHours             = kingpin.Flag("purge-keys-after-hours", "How many hours before a key is purged.").Envar("PURGE_KEYS_AFTER_HOURS").Required().Int()
+	serviceAccountProjectID         = kingpin.Flag("service-account-project-id", "The Google Cloud project id in which to create service accounts; required for the controller.").Envar("SERVICE_ACCOUNT_PROJECT_ID").String()
+	serviceAccountProjectPool       = kingpin.Flag("service-account-project-pool", "Comma-separated list of further Google Cloud project ids to create service accounts in once the service-account-project-id has reached max-service-accounts-per-project.").Default("").Envar("SERVICE_ACCOUNT_PROJECT_POOL").String()
+	maxServiceAccountsPerProject    = kingpin.Flag("max-service-accounts-per-project", "The maximum number of service accounts in a project before new ones are created in the next project of the pool; set it to the project's service account quota. 0 means no limit.").Default("0").Envar("MAX_SERVICE_ACCOUNTS_PER_PROJECT").Int()
+	serviceAccountProjectMappings   = kingpin.Flag("service-account-project-mappings", "Comma-separated list of '<namespace pattern>=<project id>' pairs to create the service accounts for matching namespaces in another project than the service-account-project-id, for example 'team-a-*=team-a-service-accounts'; the first matching pattern is used.").Default("").Envar("SERVICE_ACCOUNT_PROJECT_MAPPINGS").String()
+	keyRotationAfterHours           = kingpin.Flag("key-rotation-after-hours", "How many hours before a key is rotated; required for the controller.").Envar("KEY_ROTATION_AFTER_HOURS").Int()
+	purgeKeysAfterHours             = kingpin.Flag("purge-keys-after-hours", "How many hours before a key is purged; required for the controller.").Envar("PURGE_KEYS_AFTER_HOURS").Int()
+	localProjectIDOverride          = kingpin.Flag("local-project-id", "The Google Cloud project id of the cluster, used in the display names of service accounts; retrieved from the metadata server if empty.").Default("").Envar("LOCAL_PROJECT_ID").String()
+	minKeyRotationAfterHours        = kingpin.Flag("min-key-rotation-after-hours", "The minimum number of hours before a key is rotated that secrets and namespaces can set with an annotation; 0 means no minimum.").Default("1").Envar("MIN_KEY_ROTATION_AFTER_HOURS").Int()
+	maxKeyRotationAfterHours        = kingpin.Flag("max-key-rotation-after-hours", "The maximum number of hours before a key is rotated that secrets and namespaces can set with an annotation; -1 means the key-rotation-after-hours and 0 means no maximum.").Default("-1").Envar("MAX_KEY_ROTATION_AFTER_HOURS").Int()
+	minPurgeKeysAfterHours          = kingpin.Flag("min-purge-keys-after-hours", "The minimum number of hours before a key is purged that secrets and namespaces can set with an annotation; 0 means no minimum.").Default("1").Envar("MIN_PURGE_KEYS_AFTER_HOURS").Int()
+	maxPurgeKeysAfterHours          = kingpin.Flag("max-purge-keys-after-hours", "The maximum number of hours before a key is purged that secrets and namespaces can set with an annotation; -1 means the purge-keys-after-hours and 0 means no maximum.").Default("-1").Envar("MAX_PURGE_KEYS_AFTER_HOURS").Int()
+	rotationJitterPercentage        = kingpin.Flag("rotation-jitter-percentage", "Percentage of the rotation interval by which the rotation of each secret is brought forward, determined by the secret's namespace and name, to spread rotations evenly over time without exceeding the interval.").Default("10").Envar("ROTATION_JITTER_PERCENTAGE").Int()
+	maxRotationsPerHour             = kingpin.Flag("max-rotations-per-hour", "The maximum number of scheduled key rotations per hour across all secrets; due rotations over this budget are queued. 0 means no limit.").Default("0").Envar("MAX_ROTATIONS_PER_HOUR").Int()
+	maintenanceWindows              = kingpin.Flag("maintenance-windows", "Semicolon-separated list of weekly windows in the form '<days> <HH:MM>-<HH:MM>' during which scheduled key rotations and purges are allowed, for example 'Mon-Fri 09:00-17:00'; empty means always.").Default("").Envar("MAINTENANCE_WINDOWS").String()
+	maintenanceWindowsTimezone      = kingpin.Flag("maintenance-windows-timezone", "The timezone of the maintenance windows.").Default("UTC").Envar("MAINTENANCE_WINDOWS_TIMEZONE").String()
+	consumerPickupDeadlineHours     = kingpin.Flag("consumer-pickup-deadline-hours", "How many hours after a rotation all pods consuming a secret with consumer-aware purging should have picked up the new key before an alert is raised.").Default("24").Envar("CONSUMER_PICKUP_DEADLINE_HOURS").Int()
+	disableKeysObservationHours     = kingpin.Flag("disable-keys-observation-hours", "How many hours a purged key stays disabled before it is deleted.").Default("24").Envar("DISABLE_KEYS_OBSERVATION_HOURS").Int()
+	keyVerificationIntervalMinutes  = kingpin.Flag("key-verification-interval-minutes", "How many minutes between checks whether the key stored in a secret is still an active key for its service account.").Default("60").Envar("KEY_VERIFICATION_INTERVAL_MINUTES").Int()
+	deletedServiceAccountAction     = kingpin.Flag("deleted-service-account-action", "What to do when a service account has been deleted outside of this controller: undelete it (and recreate it if that fails), clear the state to recreate it or only report it.").Default("undelete").Envar("DELETED_SERVICE_ACCOUNT_ACTION").Enum("undelete", "recreate", "none")
+	includeNamespaces               = kingpin.Flag("include-namespaces", "Comma-separated list of namespaces to manage secrets and service accounts in; empty means all namespaces.").Default("").Envar("INCLUDE_NAMESPACES").String()
+	excludeNamespaces               = kingpin.Flag("exclude-namespaces", "Comma-separated list of namespaces not to manage secrets and service accounts in.").Default("").Envar("EXCLUDE_NAMESPACES").String()
+	namespaceLabelSelector          = kingpin.Flag("namespace-label-selector", "Label selector for the namespaces to manage secrets and service accounts in; empty means all namespaces.").Default("").Envar("NAMESPACE_LABEL_SELECTOR").String()
+	labelSelector                   = kingpin.Flag("label-selector", "Label selector for the secrets and service accounts to manage; empty means all.").Default("").Envar("LABEL_SELECTOR").String()
+	webhookEnabled                  = kingpin.Flag("webhook-enabled", "If set the admission webhooks are served.").Default("false").Envar("WEBHOOK_ENABLED").Bool()
+	webhookPort                     = kingpin.Flag("webhook-port", "The port to serve the admission webhooks on.").Default("8443").Envar("WEBHOOK_PORT").Int()
+	webhookTLSCertFile              = kingpin.Flag("webhook-tls-cert-file", "The tls certificate file for serving the admission webhooks.").Default("/webhook-tls/tls.crt").Envar("WEBHOOK_TLS_CERT_FILE").String()
+	webhookTLSKeyFile               = kingpin.Flag("webhook-tls-key-file", "The tls private key file for serving the admission webhooks.").Default("/webhook-tls/tls.key").Envar("WEBHOOK_TLS_KEY_FILE").String()
 	allowDisableKeyRotationOverride = kingpin.Flag("allow-disable-key-rotation-override", "If set on a per secret basis key rotation can be disabled with an annotation.").Default("false").OverrideDefaultFromEnvar("ALLOW_DISABLE_KEY_ROTATION_OVERRIDE").Bool()
 
+	// decides which namespaces are managed, set from the command line parameters in main
+	namespaceFilter *NamespaceFilter
+
+	// limits the number of scheduled key rotations per hour, set from the command line parameters in main
+	rotationBudget = NewRotationBudget(0)
+
+	// keeps track of when the key stored in each secret has last been verified, to limit the number of calls to the iam api
+	lastKeyVerifications      = map[string]time.Time{}
+	lastKeyVerificationsMutex sync.Mutex
+
+	// keeps track of when a deferred rotation or purge of each secret has last been reported, since the lastAttempt lock isn't taken while deferring
+	lastDeferralReports      = map[string]time.Time{}
+	lastDeferralReportsMutex sync.Mutex
+
 	appgroup  string
 	app       string
 	version   string
@@ -92,6 +184,13 @@ var (
 		},
 		[]string{"namespace", "status", "initiator", "type", "mode"},
 	)
+	serviceAccountRecoverTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_gcp_service_account_recover_totals",
+			Help: "Number of recovered service accounts in GCP that have been deleted outside of this controller.",
+		},
+		[]string{"namespace", "status", "initiator", "type", "mode"},
+	)
 	keyRotationTotals = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "estafette_gcp_key_rotation_totals",
@@ -99,6 +198,61 @@ var (
 		},
 		[]string{"namespace", "status", "initiator", "type", "mode"},
 	)
+	invalidStateTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_gcp_invalid_state_totals",
+			Help: "Number of times a secret or service account wasn't acted upon because its annotations or stored state can't be parsed.",
+		},
+		[]string{"namespace", "initiator", "type", "state"},
+	)
+	keyPurgeHoldTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_gcp_key_purge_hold_totals",
+			Help: "Number of times purging keys was held because pods consuming the secret haven't picked up the new key.",
+		},
+		[]string{"namespace", "status", "initiator", "type", "mode"},
+	)
+	workloadRestartTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_gcp_workload_restart_totals",
+			Help: "Number of workloads restarted to pick up a new service account key.",
+		},
+		[]string{"namespace", "status", "initiator", "type", "mode"},
+	)
+	keyRotationBacklog = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "estafette_gcp_key_rotation_backlog",
+			Help: "Number of secrets with a key up for rotation waiting for rotation budget.",
+		},
+	)
+	keyRevocationTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_gcp_key_revocation_totals",
+			Help: "Number of emergency revocations of all service account keys in GCP.",
+		},
+		[]string{"namespace", "status", "initiator", "type", "mode"},
+	)
+	keyEvictionTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_gcp_key_eviction_totals",
+			Help: "Number of service account keys evicted in GCP because the account reached its key limit.",
+		},
+		[]string{"namespace", "status", "initiator", "type", "mode"},
+	)
+	keyVerificationTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_gcp_key_verification_totals",
+			Help: "Number of verified service account keys stored in secrets.",
+		},
+		[]string{"namespace", "status", "initiator", "type", "mode"},
+	)
+	keyDisableTotals = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "estafette_gcp_key_disable_totals",
+			Help: "Number of disabled service account keys GCP.",
+		},
+		[]string{"namespace", "status", "initiator", "type", "mode"},
+	)
 	keyPurgeTotals = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "estafette_gcp_key_purge_totals",
@@ -113,63 +267,120 @@ func init() {
 	prometheus.MustRegister(serviceAccountCreateTotals)
 	prometheus.MustRegister(serviceAccountRetrieveTotals)
 	prometheus.MustRegister(serviceAccountDeleteTotals)
+	prometheus.MustRegister(serviceAccountRecoverTotals)
 	prometheus.MustRegister(keyRotationTotals)
+	prometheus.MustRegister(invalidStateTotals)
+	prometheus.MustRegister(keyPurgeHoldTotals)
+	prometheus.MustRegister(workloadRestartTotals)
+	prometheus.MustRegister(keyRotationBacklog)
+	prometheus.MustRegister(keyRevocationTotals)
+	prometheus.MustRegister(keyEvictionTotals)
+	prometheus.MustRegister(keyVerificationTotals)
+	prometheus.MustRegister(keyDisableTotals)
 	prometheus.MustRegister(keyPurgeTotals)
 }
 
 func main() {
 
 	// parse command line parameters
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	// init log format from envvar ESTAFETTE_LOG_FORMAT
 	foundation.InitLoggingFromEnv(foundation.NewApplicationInfo(appgroup, app, version, branch, revision, buildDate))
 
-	// init /liveness endpoint
-	foundation.InitLiveness()
+	// the revoke command only acts on a single secret, so it doesn't need most of the controller's settings and can run from outside the cluster
+	if command == revokeCommand.FullCommand() {
+		kubeClientset, err := getKubeClientset(*revokeKubeconfig)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Creating kubernetes clientset failed")
+		}
 
-	// create kubernetes api clientset
-	kubeClientConfig, err := rest.InClusterConfig()
-	if err != nil {
-		log.Fatal().Err(err)
+		localProjectID, err := getLocalProjectID()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Retrieving local project id failed, set it with --local-project-id")
+		}
+
+		// only service accounts in the configured projects or the project annotated on the namespace are revoked
+		projectMappings, err := parseServiceAccountProjectMappings(*serviceAccountProjectMappings)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid service account project mappings")
+		}
+
+		iamServices, err := NewGoogleCloudIAMServices(*serviceAccountProjectID, splitCommaSeparatedList(*serviceAccountProjectPool), 0, localProjectID, projectMappings)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Creating GoogleCloudIAMService failed")
+		}
+
+		err = runRevokeCommand(kubeClientset, iamServices, *revokeNamespace, *revokeSecretName)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Revoking keys for secret %v.%v failed", *revokeSecretName, *revokeNamespace)
+		}
+		return
+	}
+
+	if *serviceAccountProjectID == "" || *keyRotationAfterHours <= 0 || *purgeKeysAfterHours <= 0 {
+		log.Fatal().Msg("Flags --service-account-project-id, --key-rotation-after-hours and --purge-keys-after-hours are required for the controller")
+	}
+
+	// by default secrets and namespaces can only shorten the intervals, so they can't effectively disable rotating or purging keys
+	if *maxKeyRotationAfterHours < 0 {
+		*maxKeyRotationAfterHours = *keyRotationAfterHours
+	}
+	if *maxPurgeKeysAfterHours < 0 {
+		*maxPurgeKeysAfterHours = *purgeKeysAfterHours
 	}
 
-	kubeClientset, err := kubernetes.NewForConfig(kubeClientConfig)
+	// validate the controller's maintenance windows, since secrets with invalid windows fall back to them
+	_, err := parseMaintenanceWindows(*maintenanceWindows)
 	if err != nil {
-		log.Fatal().Err(err)
+		log.Fatal().Err(err).Msg("Invalid maintenance windows")
+	}
+	_, err = time.LoadLocation(*maintenanceWindowsTimezone)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid maintenance windows timezone")
 	}
 
-	// get project id from metadata server (might be impossible with metadata disabled, see https://cloud.google.com/kubernetes-engine/docs/how-to/protecting-cluster-metadata)
-	client := pester.New()
-	request, err := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/project/project-id", nil)
+	rotationBudget = NewRotationBudget(*maxRotationsPerHour)
+
+	projectMappings, err := parseServiceAccountProjectMappings(*serviceAccountProjectMappings)
 	if err != nil {
-		log.Fatal().Err(err)
+		log.Fatal().Err(err).Msg("Invalid service account project mappings")
 	}
-	request.Header.Add("Metadata-Flavor", "Google")
-	resp, err := client.Do(request)
+
+	// create kubernetes api clientset
+	kubeClientset, err := getKubeClientset("")
 	if err != nil {
 		log.Fatal().Err(err)
 	}
 
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	localProjectID, err := getLocalProjectID()
 	if err != nil {
 		log.Fatal().Err(err)
 	}
-	localProjectID := string(body)
-	if resp.StatusCode != http.StatusOK {
-		log.Fatal().Str("body", string(body)).Msgf("Failed retrieving project id from metadata with status code %v", resp.StatusCode)
-	}
 
-	// create service to Google Cloud IAM
-	iamService, err := NewGoogleCloudIAMService(*serviceAccountProjectID, localProjectID)
+	// create services to Google Cloud IAM for each service account project
+	iamServices, err := NewGoogleCloudIAMServices(*serviceAccountProjectID, splitCommaSeparatedList(*serviceAccountProjectPool), *maxServiceAccountsPerProject, localProjectID, projectMappings)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Creating GoogleCloudIAMService failed")
 	}
 
+	namespaceFilter, err = NewNamespaceFilter(kubeClientset, *includeNamespaces, *excludeNamespaces, *namespaceLabelSelector)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid namespace label selector")
+	}
+	if *labelSelector != "" {
+		_, err = labels.Parse(*labelSelector)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid label selector")
+		}
+	}
+
+	// init /liveness endpoint
+	foundation.InitLiveness()
+
 	foundation.WatchForFileChanges(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"), func(event fsnotify.Event) {
 		log.Info().Msg("Key file changed, reinitializing iam service...")
-		iamService, err = NewGoogleCloudIAMService(*serviceAccountProjectID, localProjectID)
+		err := iamServices.Reinitialize()
 		if err != nil {
 			log.Fatal().Err(err).Msg("Creating GoogleCloudIAMService failed")
 		}
@@ -177,29 +388,85 @@ func main() {
 
 	foundation.InitMetrics()
 
+	if *webhookEnabled {
+		err = startWebhookServer(kubeClientset)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Starting admission webhook server failed")
+		}
+	}
+
 	gracefulShutdown, waitGroup := foundation.InitGracefulShutdownHandling()
 
 	// watch kubernetes secrets for all namespaces
-	go watchSecrets(waitGroup, kubeClientset, iamService)
+	go watchSecrets(waitGroup, kubeClientset, iamServices)
 
-	go listSecrets(waitGroup, kubeClientset, iamService)
+	go listSecrets(waitGroup, kubeClientset, iamServices)
 
 	// watch kubernetes service accounts for all namespaces
-	go watchServiceAccounts(waitGroup, kubeClientset, iamService)
+	go watchServiceAccounts(waitGroup, kubeClientset, iamServices)
 
-	go listServiceAccounts(waitGroup, kubeClientset, iamService)
+	go listServiceAccounts(waitGroup, kubeClientset, iamServices)
 
 	foundation.HandleGracefulShutdown(gracefulShutdown, waitGroup)
 }
 
+// getKubeClientset returns a clientset for the cluster the controller runs in, or else for the cluster in the kubeconfig file if one is given
+func getKubeClientset(kubeconfig string) (*kubernetes.Clientset, error) {
+
+	kubeClientConfig, err := rest.InClusterConfig()
+	if err != nil {
+		if kubeconfig == "" {
+			return nil, err
+		}
+		kubeClientConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return kubernetes.NewForConfig(kubeClientConfig)
+}
+
+// getLocalProjectID returns the project id set with the local-project-id flag, or else retrieves it from the metadata server (might be impossible with metadata disabled, see https://cloud.google.com/kubernetes-engine/docs/how-to/protecting-cluster-metadata)
+func getLocalProjectID() (string, error) {
+
+	if *localProjectIDOverride != "" {
+		return *localProjectIDOverride, nil
+	}
+
+	client := pester.New()
+	request, err := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/project/project-id", nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Add("Metadata-Flavor", "Google")
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Failed retrieving project id from metadata with status code %v: %v", resp.StatusCode, string(body))
+	}
+
+	return string(body), nil
+}
+
 // Kubernetes secret
-func watchSecrets(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService) {
+func watchSecrets(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset, iamServices *GoogleCloudIAMServices) {
 	// loop indefinitely
 	for {
-		log.Info().Msg("Watching secrets for all namespaces...")
+		log.Info().Msgf("Watching secrets for %v...", namespaceFilter.Description())
 		timeoutSeconds := int64(300)
-		watcher, err := kubeClientset.CoreV1().Secrets("").Watch(context.Background(), metav1.ListOptions{
+		watcher, err := kubeClientset.CoreV1().Secrets(namespaceFilter.Namespace()).Watch(context.Background(), metav1.ListOptions{
 			TimeoutSeconds: &timeoutSeconds,
+			LabelSelector:  *labelSelector,
+			FieldSelector:  namespaceFilter.FieldSelector(),
 		})
 
 		if err != nil {
@@ -219,9 +486,13 @@ func watchSecrets(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset
 					break
 				}
 
+				if !namespaceFilter.IsManaged(secret.Namespace) {
+					continue
+				}
+
 				if event.Type == watch.Added || event.Type == watch.Modified {
 					waitGroup.Add(1)
-					err := processSecret(kubeClientset, iamService, secret, fmt.Sprintf("watcher:%v", event.Type))
+					err := processSecret(kubeClientset, iamServices, secret, fmt.Sprintf("watcher:%v", event.Type))
 					waitGroup.Done()
 
 					if err != nil {
@@ -230,8 +501,19 @@ func watchSecrets(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset
 				}
 
 				if event.Type == watch.Deleted {
+					// a secret that no longer matches the label selector is reported as deleted as well, so only delete the service account if the secret is really gone
+					_, err := kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+					if !errors.IsNotFound(err) {
+						if err != nil {
+							log.Error().Err(err).Msgf("[watcher:%v] Secret %v.%v - Failed checking whether secret has been deleted, not deleting service account", event.Type, secret.Name, secret.Namespace)
+						} else {
+							log.Info().Msgf("[watcher:%v] Secret %v.%v - Secret still exists but no longer matches the label selector, not deleting service account", event.Type, secret.Name, secret.Namespace)
+						}
+						continue
+					}
+
 					waitGroup.Add(1)
-					err := deleteSecret(kubeClientset, iamService, secret, fmt.Sprintf("watcher:%v", event.Type))
+					err = deleteSecret(kubeClientset, iamServices, secret, fmt.Sprintf("watcher:%v", event.Type))
 					waitGroup.Done()
 
 					if err != nil {
@@ -248,7 +530,7 @@ func watchSecrets(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset
 	}
 }
 
-func listSecrets(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService) {
+func listSecrets(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset, iamServices *GoogleCloudIAMServices) {
 	// sleep random time before polling in order to avoid race conditions (look at waitgroups in the future)
 	sleepTime := foundation.ApplyJitter(30)
 	log.Info().Msgf("Sleeping for %v seconds...", sleepTime)
@@ -258,8 +540,11 @@ func listSecrets(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset,
 	for {
 
 		// get secrets for all namespaces
-		log.Info().Msg("Listing secrets for all namespaces...")
-		secrets, err := kubeClientset.CoreV1().Secrets("").List(context.Background(), metav1.ListOptions{})
+		log.Info().Msgf("Listing secrets for %v...", namespaceFilter.Description())
+		secrets, err := kubeClientset.CoreV1().Secrets(namespaceFilter.Namespace()).List(context.Background(), metav1.ListOptions{
+			LabelSelector: *labelSelector,
+			FieldSelector: namespaceFilter.FieldSelector(),
+		})
 		if err != nil {
 			log.Error().Err(err).Msg("ListSecrets call failed")
 		}
@@ -267,8 +552,12 @@ func listSecrets(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset,
 
 		// loop all secrets
 		for _, secret := range secrets.Items {
+			if !namespaceFilter.IsManaged(secret.Namespace) {
+				continue
+			}
+
 			waitGroup.Add(1)
-			err := processSecret(kubeClientset, iamService, &secret, "POLLER")
+			err := processSecret(kubeClientset, iamServices, &secret, "POLLER")
 			waitGroup.Done()
 
 			if err != nil {
@@ -283,10 +572,19 @@ func listSecrets(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset,
 	}
 }
 
-func getDesiredSecretState(secret *v1.Secret) (state GCPServiceAccountState) {
+func getDesiredSecretState(secret *v1.Secret, namespaceAnnotations map[string]string) (state GCPServiceAccountState, err error) {
 
 	var ok bool
 
+	// keep track of annotations that can't be parsed, to report them instead of silently acting on default values
+	parseErrors := []string{}
+
+	// the namespace can set defaults and restrictions for all secrets inside it
+	namespacePolicy, err := getNamespacePolicy(namespaceAnnotations)
+	if err != nil {
+		parseErrors = append(parseErrors, err.Error())
+	}
+
 	// get annotations or set default value
 	state.Enabled, ok = secret.ObjectMeta.Annotations[annotationGCPServiceAccount]
 	if !ok {
@@ -300,6 +598,9 @@ func getDesiredSecretState(secret *v1.Secret) (state GCPServiceAccountState) {
 
 	state.Filename, ok = secret.ObjectMeta.Annotations[annotationGCPServiceAccountFilename]
 	if !ok {
+		state.Filename = namespacePolicy.Filename
+	}
+	if state.Filename == "" {
 		state.Filename = "service-account-key.json"
 	}
 
@@ -307,10 +608,21 @@ func getDesiredSecretState(secret *v1.Secret) (state GCPServiceAccountState) {
 	if !ok {
 		state.DisableKeyRotation = false
 	} else {
-		var err error
 		state.DisableKeyRotation, err = strconv.ParseBool(disableKeyRotationValue)
 		if err != nil {
 			state.DisableKeyRotation = false
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which can't be parsed: %v", annotationGCPServiceAccountDisableKeyRotation, disableKeyRotationValue, err))
+		}
+	}
+
+	derivedFieldsValue, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccountDerivedFields]
+	if !ok {
+		state.DerivedFields = false
+	} else {
+		state.DerivedFields, err = strconv.ParseBool(derivedFieldsValue)
+		if err != nil {
+			state.DerivedFields = false
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which can't be parsed: %v", annotationGCPServiceAccountDerivedFields, derivedFieldsValue, err))
 		}
 	}
 
@@ -321,13 +633,158 @@ func getDesiredSecretState(secret *v1.Secret) (state GCPServiceAccountState) {
 		err := json.Unmarshal([]byte(serviceAccountPermissionsString), &state.Permissions)
 		if err != nil {
 			state.Permissions = []GCPServiceAccountPermission{}
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v can't be parsed as json: %v", annotationGCPServiceAccountPermissions, err))
 		}
 	}
 
-	return
+	hmacKeysValue, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccountHmacKeys]
+	if !ok {
+		state.HmacKeys = false
+	} else {
+		state.HmacKeys, err = strconv.ParseBool(hmacKeysValue)
+		if err != nil {
+			state.HmacKeys = false
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which can't be parsed: %v", annotationGCPServiceAccountHmacKeys, hmacKeysValue, err))
+		}
+	}
+
+	keepPreviousKeyValue, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccountKeepPreviousKey]
+	if !ok {
+		state.KeepPreviousKey = false
+	} else {
+		state.KeepPreviousKey, err = strconv.ParseBool(keepPreviousKeyValue)
+		if err != nil {
+			state.KeepPreviousKey = false
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which can't be parsed: %v", annotationGCPServiceAccountKeepPreviousKey, keepPreviousKeyValue, err))
+		}
+	}
+
+	restartWorkloadsValue, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccountRestartWorkloads]
+	if !ok {
+		state.RestartWorkloads = false
+	} else {
+		state.RestartWorkloads, err = strconv.ParseBool(restartWorkloadsValue)
+		if err != nil {
+			state.RestartWorkloads = false
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which can't be parsed: %v", annotationGCPServiceAccountRestartWorkloads, restartWorkloadsValue, err))
+		}
+	}
+
+	consumerAwarePurgeValue, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccountConsumerAwarePurge]
+	if !ok {
+		state.ConsumerAwarePurge = false
+	} else {
+		state.ConsumerAwarePurge, err = strconv.ParseBool(consumerAwarePurgeValue)
+		if err != nil {
+			state.ConsumerAwarePurge = false
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which can't be parsed: %v", annotationGCPServiceAccountConsumerAwarePurge, consumerAwarePurgeValue, err))
+		}
+	}
+
+	dockerRegistriesString, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccountDockerRegistries]
+	if ok {
+		for _, registry := range strings.Split(dockerRegistriesString, ",") {
+			registry = strings.TrimSpace(registry)
+			if registry != "" {
+				state.DockerRegistries = append(state.DockerRegistries, registry)
+			}
+		}
+	}
+
+	reenableKeysString, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccountReenableKeys]
+	if ok {
+		for _, keyID := range strings.Split(reenableKeysString, ",") {
+			keyID = strings.TrimSpace(keyID)
+			if keyID != "" {
+				state.ReenableKeyIDs = append(state.ReenableKeyIDs, keyID)
+			}
+		}
+	}
+
+	keyRotationAfterHoursValue, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccountKeyRotationAfterHours]
+	if ok {
+		state.KeyRotationAfterHours, err = strconv.Atoi(keyRotationAfterHoursValue)
+		if err != nil {
+			state.KeyRotationAfterHours = 0
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which can't be parsed: %v", annotationGCPServiceAccountKeyRotationAfterHours, keyRotationAfterHoursValue, err))
+		} else if state.KeyRotationAfterHours <= 0 {
+			// a non-positive value would silently fall back to the namespace or controller default
+			state.KeyRotationAfterHours = 0
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which isn't a positive number of hours", annotationGCPServiceAccountKeyRotationAfterHours, keyRotationAfterHoursValue))
+		}
+	}
+
+	purgeKeysAfterHoursValue, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccountPurgeKeysAfterHours]
+	if ok {
+		state.PurgeKeysAfterHours, err = strconv.Atoi(purgeKeysAfterHoursValue)
+		if err != nil {
+			state.PurgeKeysAfterHours = 0
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which can't be parsed: %v", annotationGCPServiceAccountPurgeKeysAfterHours, purgeKeysAfterHoursValue, err))
+		} else if state.PurgeKeysAfterHours <= 0 {
+			// a non-positive value would silently fall back to the namespace or controller default
+			state.PurgeKeysAfterHours = 0
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which isn't a positive number of hours", annotationGCPServiceAccountPurgeKeysAfterHours, purgeKeysAfterHoursValue))
+		}
+	}
+
+	state.MaintenanceWindows, ok = secret.ObjectMeta.Annotations[annotationGCPServiceAccountMaintenanceWindows]
+	if !ok {
+		state.MaintenanceWindows = ""
+	}
+
+	state.MaintenanceWindowsTimezone, ok = secret.ObjectMeta.Annotations[annotationGCPServiceAccountMaintenanceWindowsTimezone]
+	if !ok {
+		state.MaintenanceWindowsTimezone = ""
+	}
+
+	// invalid windows fall back to the controller's windows; windows in an invalid timezone do as well, since they can't be placed in time
+	if state.MaintenanceWindows != "" {
+		if _, err := parseMaintenanceWindows(state.MaintenanceWindows); err != nil {
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which can't be parsed: %v", annotationGCPServiceAccountMaintenanceWindows, state.MaintenanceWindows, err))
+			state.MaintenanceWindows = ""
+		}
+	}
+	if state.MaintenanceWindowsTimezone != "" {
+		if _, err := time.LoadLocation(state.MaintenanceWindowsTimezone); err != nil {
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v has value '%v', which isn't a known timezone: %v", annotationGCPServiceAccountMaintenanceWindowsTimezone, state.MaintenanceWindowsTimezone, err))
+			state.MaintenanceWindows = ""
+			state.MaintenanceWindowsTimezone = ""
+		}
+	}
+
+	state.RevokeNowToken, ok = secret.ObjectMeta.Annotations[annotationGCPServiceAccountRevokeNow]
+	if !ok {
+		state.RevokeNowToken = ""
+	}
+
+	state.RotateNowToken, ok = secret.ObjectMeta.Annotations[annotationGCPServiceAccountRotateNow]
+	if !ok {
+		state.RotateNowToken = ""
+	}
+
+	templatesString, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccountTemplates]
+	if ok {
+		err := json.Unmarshal([]byte(templatesString), &state.Templates)
+		if err != nil {
+			state.Templates = nil
+			parseErrors = append(parseErrors, fmt.Sprintf("Annotation %v can't be parsed as json: %v", annotationGCPServiceAccountTemplates, err))
+		}
+	}
+
+	applyEffectiveIntervals(&state, namespaceAnnotations)
+
+	// an invalid state is reported by getCurrentSecretState's callers, here it only tells whether the account exists already
+	currentState, _ := getCurrentSecretState(secret)
+	applyNamespacePolicy(&state, namespacePolicy, currentState, *mode != "rotate_keys_only")
+
+	if len(parseErrors) > 0 {
+		return state, fmt.Errorf("%v", strings.Join(parseErrors, "; "))
+	}
+
+	return state, nil
 }
 
-func getCurrentSecretState(secret *v1.Secret) (state GCPServiceAccountState) {
+func getCurrentSecretState(secret *v1.Secret) (state GCPServiceAccountState, err error) {
 
 	// get state stored in annotations if present or set to empty struct
 	gcpServiceAccountStateString, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccountState]
@@ -337,10 +794,9 @@ func getCurrentSecretState(secret *v1.Secret) (state GCPServiceAccountState) {
 		return
 	}
 
-	if err := json.Unmarshal([]byte(gcpServiceAccountStateString), &state); err != nil {
-		// couldn't deserialize, setting to default struct
-		state = GCPServiceAccountState{}
-		return
+	if err = json.Unmarshal([]byte(gcpServiceAccountStateString), &state); err != nil {
+		// couldn't deserialize; an empty state would lead to creating a duplicate service account, so report it instead
+		return GCPServiceAccountState{}, fmt.Errorf("Annotation %v can't be parsed as json: %v", annotationGCPServiceAccountState, err)
 	}
 
 	// return deserialized state
@@ -368,6 +824,17 @@ func makeSecretChanges(kubeClientset *kubernetes.Clientset, iamService *GoogleCl
 		}
 	}
 
+	if desiredState.Enabled == "true" && len(desiredState.PolicyViolations) > 0 {
+		log.Warn().Msgf("[%v] Secret %v.%v - Ignoring parts of the annotations not allowed in this namespace: %v", initiator, secret.Name, secret.Namespace, strings.Join(desiredState.PolicyViolations, "; "))
+		_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "PolicyViolation", strings.Join(desiredState.PolicyViolations, "; "))
+	}
+
+	if desiredState.Enabled == "true" && desiredState.WorkloadIdentityOnly {
+		log.Warn().Msgf("[%v] Secret %v.%v - Namespace only allows Workload Identity, not managing a service account for this secret", initiator, secret.Name, secret.Namespace)
+		_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "PolicyViolation", fmt.Sprintf("Namespace only allows Workload Identity; use a service account annotated with %v instead of a secret", annotationGCPServiceAccount))
+		return nil
+	}
+
 	newAccount, err := makeSecretChangesGetOrCreateServiceAccount(kubeClientset, iamService, secret, initiator, desiredState, &currentState, lastAttempt)
 	if err != nil {
 		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed creating service account %v", initiator, secret.Name, secret.Namespace, desiredState.Name)
@@ -378,27 +845,189 @@ func makeSecretChanges(kubeClientset *kubernetes.Clientset, iamService *GoogleCl
 		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed setting permissions for service account %v", initiator, secret.Name, secret.Namespace, desiredState.Name)
 	}
 
-	err = makeSecretChangesRotateKeys(kubeClientset, iamService, secret, initiator, desiredState, &currentState, lastAttempt, lastRenewed, newAccount)
+	// an emergency revocation takes precedence over all other key changes
+	revoked, err := makeSecretChangesRevokeKeys(kubeClientset, iamService, secret, initiator, desiredState, &currentState)
+	if err != nil {
+		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed revoking keys for service account %v", initiator, secret.Name, secret.Namespace, desiredState.Name)
+	}
+	if revoked {
+		return nil
+	}
+
+	// with keys disabled for the namespace the service account is kept, but no keys are verified, issued or re-enabled; previous keys are still purged
+	if desiredState.KeysDisabled {
+		if desiredState.Enabled == "true" {
+			_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "PolicyViolation", "Namespace has keys disabled; no keys are issued or rotated for this secret")
+		}
+
+		err = makeSecretChangesPurgeKeys(kubeClientset, iamService, secret, initiator, desiredState, &currentState, lastAttempt, lastRenewed)
+		if err != nil {
+			log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed purging keys for service account %v", initiator, secret.Name, secret.Namespace, desiredState.Name)
+		}
+
+		return nil
+	}
+
+	// keep track of whether any of the steps finds out the service account has been deleted outside of this controller
+	serviceAccountNotFound := false
+
+	reissueKey, err := makeSecretChangesVerifyKey(kubeClientset, iamService, secret, initiator, desiredState, &currentState, lastAttempt)
+	if err != nil {
+		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed verifying key for service account %v", initiator, secret.Name, secret.Namespace, desiredState.Name)
+		serviceAccountNotFound = serviceAccountNotFound || err == ErrServiceAccountNotFound
+	}
+
+	err = makeSecretChangesRotateKeys(kubeClientset, iamService, secret, initiator, desiredState, &currentState, lastAttempt, lastRenewed, newAccount, reissueKey)
 	if err != nil {
 		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed rotating keys for service account %v", initiator, secret.Name, secret.Namespace, desiredState.Name)
+		serviceAccountNotFound = serviceAccountNotFound || err == ErrServiceAccountNotFound
+	}
+
+	err = makeSecretChangesSyncOutputs(kubeClientset, iamService, secret, initiator, desiredState, &currentState, lastAttempt)
+	if err != nil {
+		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed writing outputs of the key of service account %v", initiator, secret.Name, secret.Namespace, desiredState.Name)
+	}
+
+	err = makeSecretChangesReenableKeys(kubeClientset, iamService, secret, initiator, desiredState, &currentState, lastAttempt)
+	if err != nil {
+		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed re-enabling keys for service account %v", initiator, secret.Name, secret.Namespace, desiredState.Name)
+		serviceAccountNotFound = serviceAccountNotFound || err == ErrServiceAccountNotFound
 	}
 
 	err = makeSecretChangesPurgeKeys(kubeClientset, iamService, secret, initiator, desiredState, &currentState, lastAttempt, lastRenewed)
 	if err != nil {
 		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed purging keys for service account %v", initiator, secret.Name, secret.Namespace, desiredState.Name)
+		serviceAccountNotFound = serviceAccountNotFound || err == ErrServiceAccountNotFound
+	}
+
+	if serviceAccountNotFound {
+		err = makeSecretChangesRecoverServiceAccount(kubeClientset, iamService, secret, initiator, desiredState, &currentState)
+		if err != nil {
+			log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed recovering deleted service account %v", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName)
+		}
+
+		return nil
+	}
+
+	err = makeSecretChangesBackfillUniqueID(kubeClientset, iamService, secret, initiator, &currentState)
+	if err != nil {
+		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed storing unique id of service account %v", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName)
 	}
 
 	return nil
 }
 
-func makeSecretChangesGetOrCreateServiceAccount(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, lastAttempt time.Time) (created bool, err error) {
+// makeSecretChangesBackfillUniqueID stores the unique id of a service account created before it was kept in the state, so the account can be undeleted if it's deleted outside of this controller
+func makeSecretChangesBackfillUniqueID(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, currentState *GCPServiceAccountState) (err error) {
 
-	// if mode is rotate_keys_only it means the service account has been created in advance; if it's full qualified name isn't store in the FullServiceAccountName yet try and look it up by the predictable display name
-	if (*mode == "rotate_keys_only") && desiredState.Enabled == "true" && desiredState.Name != "" && time.Since(lastAttempt).Minutes() > 15 && currentState.FullServiceAccountName == "" {
+	if currentState.UniqueID != "" || currentState.FullServiceAccountName == "" {
+		return nil
+	}
 
-		log.Info().Msgf("[%v] Secret %v.%v - Service account %v has been created in advance, fetching its identifier...", initiator, secret.Name, secret.Namespace, desiredState.Name)
+	uniqueID := iamService.GetKnownUniqueID(currentState.FullServiceAccountName)
+	if uniqueID == "" {
+		return nil
+	}
 
-		// 'lock' the secret for 15 minutes by storing the last attempt timestamp to prevent hitting the rate limit if the Google Cloud IAM api call fails and to prevent the watcher and the fallback polling to operate on the secret at the same time
+	// reload secret to avoid object has been modified error
+	secret, err = kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Error().Err(err)
+		return err
+	}
+
+	currentState.UniqueID = uniqueID
+
+	log.Info().Msgf("[%v] Secret %v.%v - Storing unique id %v of service account %v...", initiator, secret.Name, secret.Namespace, uniqueID, currentState.FullServiceAccountName)
+
+	return updateSecret(kubeClientset, secret, *currentState, initiator)
+}
+
+func makeSecretChangesRecoverServiceAccount(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState) (err error) {
+
+	log.Warn().Msgf("[%v] Secret %v.%v - Service account %v has been deleted outside of this controller...", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName)
+
+	if *deletedServiceAccountAction == "none" {
+		_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "ServiceAccountDeleted", fmt.Sprintf("Service account %v has been deleted outside of this controller", currentState.FullServiceAccountName))
+		serviceAccountRecoverTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "skipped", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+		return nil
+	}
+
+	// reload secret to avoid object has been modified error
+	secret, err = kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Error().Err(err)
+		return err
+	}
+
+	// try to undelete the service account to keep its iam bindings
+	if *deletedServiceAccountAction == "undelete" && currentState.UniqueID != "" {
+		fullServiceAccountName, err := iamService.UndeleteServiceAccount(currentState.UniqueID)
+		if err == nil {
+			currentState.FullServiceAccountName = fullServiceAccountName
+
+			err = updateSecret(kubeClientset, secret, *currentState, initiator)
+			if err != nil {
+				serviceAccountRecoverTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+				return err
+			}
+
+			// verify the key in the secret on the next reconcile, since keys are not necessarily restored with the account
+			lastKeyVerificationsMutex.Lock()
+			delete(lastKeyVerifications, secret.Namespace+"/"+secret.Name)
+			lastKeyVerificationsMutex.Unlock()
+
+			log.Info().Msgf("[%v] Secret %v.%v - Service account %v has been undeleted successfully...", initiator, secret.Name, secret.Namespace, fullServiceAccountName)
+			_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeNormal, "ServiceAccountUndeleted", fmt.Sprintf("Service account %v had been deleted outside of this controller and has been undeleted", fullServiceAccountName))
+			serviceAccountRecoverTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "undeleted", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+
+			return nil
+		}
+
+		log.Warn().Err(err).Msgf("[%v] Secret %v.%v - Undeleting service account %v failed, clearing state to recreate it instead...", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName)
+		_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "ServiceAccountUndeleteFailed", fmt.Sprintf("Service account %v had been deleted outside of this controller and undeleting it failed, it's recreated without its former iam bindings: %v", currentState.FullServiceAccountName, err))
+	}
+
+	if *deletedServiceAccountAction == "undelete" && currentState.UniqueID == "" {
+		log.Warn().Msgf("[%v] Secret %v.%v - Service account %v can't be undeleted because its unique id isn't known, clearing state to recreate it instead...", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName)
+		_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "ServiceAccountUndeleteImpossible", fmt.Sprintf("Service account %v had been deleted outside of this controller and can't be undeleted because its unique id isn't known, it's recreated without its former iam bindings", currentState.FullServiceAccountName))
+	}
+
+	// clear the state so the next reconcile creates - or in rotate_keys_only mode looks up - the service account and issues a new key
+	deletedServiceAccountName := currentState.FullServiceAccountName
+	currentState.FullServiceAccountName = ""
+	currentState.FullServiceAccountEmail = ""
+	currentState.UniqueID = ""
+	currentState.LastRenewed = ""
+	currentState.LastAttempt = ""
+	currentState.ActiveKeyIDs = nil
+	currentState.IssuedKeyIDs = nil
+	currentState.UnknownKeyIDs = nil
+	currentState.DisabledKeys = nil
+	currentState.HmacAccessID = ""
+	currentState.IssuedHmacAccessIDs = nil
+
+	err = updateSecret(kubeClientset, secret, *currentState, initiator)
+	if err != nil {
+		serviceAccountRecoverTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+		return err
+	}
+
+	log.Info().Msgf("[%v] Secret %v.%v - State for deleted service account %v has been cleared to recreate it...", initiator, secret.Name, secret.Namespace, deletedServiceAccountName)
+	_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "ServiceAccountRecreating", fmt.Sprintf("Service account %v had been deleted outside of this controller and is being recreated", deletedServiceAccountName))
+	serviceAccountRecoverTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "recreated", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+
+	return nil
+}
+
+func makeSecretChangesGetOrCreateServiceAccount(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, lastAttempt time.Time) (created bool, err error) {
+
+	// if mode is rotate_keys_only it means the service account has been created in advance; if it's full qualified name isn't store in the FullServiceAccountName yet try and look it up by the predictable display name
+	if (*mode == "rotate_keys_only") && desiredState.Enabled == "true" && desiredState.Name != "" && time.Since(lastAttempt).Minutes() > 15 && currentState.FullServiceAccountName == "" {
+
+		log.Info().Msgf("[%v] Secret %v.%v - Service account %v has been created in advance, fetching its identifier...", initiator, secret.Name, secret.Namespace, desiredState.Name)
+
+		// 'lock' the secret for 15 minutes by storing the last attempt timestamp to prevent hitting the rate limit if the Google Cloud IAM api call fails and to prevent the watcher and the fallback polling to operate on the secret at the same time
 		currentState.LastAttempt = time.Now().Format(time.RFC3339)
 
 		err = updateSecret(kubeClientset, secret, *currentState, initiator)
@@ -408,7 +1037,7 @@ func makeSecretChangesGetOrCreateServiceAccount(kubeClientset *kubernetes.Client
 		}
 
 		// fecth service account by display name
-		fullServiceAccountName, _, err := iamService.GetServiceAccountByDisplayName(desiredState.Name)
+		fullServiceAccountName, _, uniqueID, err := iamService.GetServiceAccountByDisplayName(desiredState.Name)
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed retrieving service account %v by display name", desiredState.Name)
 			serviceAccountRetrieveTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
@@ -426,226 +1055,972 @@ func makeSecretChangesGetOrCreateServiceAccount(kubeClientset *kubernetes.Client
 		currentState.Enabled = desiredState.Enabled
 		currentState.Name = desiredState.Name
 		currentState.FullServiceAccountName = fullServiceAccountName
+		currentState.UniqueID = uniqueID
+
+		log.Info().Msgf("[%v] Secret %v.%v - Updating secret because a new service account has been created...", initiator, secret.Name, secret.Namespace)
+
+		err = updateSecret(kubeClientset, secret, *currentState, initiator)
+		if err != nil {
+			serviceAccountRetrieveTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			return false, err
+		}
+
+		log.Info().Msgf("[%v] Secret %v.%v - Service account name has been stored in secret successfully...", initiator, secret.Name, secret.Namespace)
+
+		serviceAccountRetrieveTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+
+		return true, nil
+	}
+
+	// check if gcp-service-account is enabled for this secret, and a service account doesn't already exist
+	if (*mode == "normal" || *mode == "convenient") && desiredState.Enabled == "true" && desiredState.Name != "" && time.Since(lastAttempt).Minutes() > 15 && currentState.FullServiceAccountName == "" {
+
+		log.Info().Msgf("[%v] Secret %v.%v - Service account %v hasn't been created yet, creating one now...", initiator, secret.Name, secret.Namespace, desiredState.Name)
+
+		// 'lock' the secret for 15 minutes by storing the last attempt timestamp to prevent hitting the rate limit if the Google Cloud IAM api call fails and to prevent the watcher and the fallback polling to operate on the secret at the same time
+		currentState.LastAttempt = time.Now().Format(time.RFC3339)
+
+		err = updateSecret(kubeClientset, secret, *currentState, initiator)
+		if err != nil {
+			serviceAccountCreateTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			return
+		}
+
+		// create service account
+		fullServiceAccountName, uniqueID, err := iamService.CreateServiceAccount(desiredState.Name)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed creating service account %v", desiredState.Name)
+			serviceAccountCreateTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			return false, err
+		}
+
+		// reload secret to avoid object has been modified error
+		secret, err = kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+		if err != nil {
+			log.Error().Err(err)
+			return false, err
+		}
+
+		// update the secret
+		currentState.Enabled = desiredState.Enabled
+		currentState.Name = desiredState.Name
+		currentState.FullServiceAccountName = fullServiceAccountName
+		currentState.UniqueID = uniqueID
 
 		log.Info().Msgf("[%v] Secret %v.%v - Updating secret because a new service account has been created...", initiator, secret.Name, secret.Namespace)
 
-		err = updateSecret(kubeClientset, secret, *currentState, initiator)
+		err = updateSecret(kubeClientset, secret, *currentState, initiator)
+		if err != nil {
+			serviceAccountCreateTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			return false, err
+		}
+
+		log.Info().Msgf("[%v] Secret %v.%v - Service account name has been stored in secret successfully...", initiator, secret.Name, secret.Namespace)
+
+		serviceAccountCreateTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+
+		return true, nil
+	}
+
+	serviceAccountRetrieveTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "skipped", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+	serviceAccountCreateTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "skipped", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+
+	return false, nil
+}
+
+func makeSecretChangesSetPermissions(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, lastAttempt, lastRenewed time.Time, newAccount bool) (err error) {
+
+	// check if gcp-service-account is enabled for this secret, and permissions have been defined
+	if (*mode == "convenient") && desiredState.Enabled == "true" && desiredState.Name != "" && (time.Since(lastAttempt).Minutes() > 15 || newAccount) && currentState.FullServiceAccountName == "" && len(currentState.Permissions) != len(desiredState.Permissions) {
+		// in convenient mode this controller can set the permissions as well; but awarding this controller with the possibility to set permissions is not without risk
+
+		err = iamService.SetServiceAccountRoleBinding(currentState.FullServiceAccountName, desiredState.Permissions)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Setting permissions for service account %v failed", desiredState.Name)
+		}
+	}
+
+	return nil
+}
+
+func makeSecretChangesVerifyKey(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, lastAttempt time.Time) (reissue bool, err error) {
+
+	filename := desiredState.Filename
+	if filename == "" {
+		filename = "service-account-key.json"
+	}
+	keyfileData, fileExists := secret.Data[filename]
+
+	if (*mode == "normal" || *mode == "convenient" || *mode == "rotate_keys_only") &&
+		desiredState.Enabled == "true" &&
+		time.Since(lastAttempt).Minutes() > 15 &&
+		currentState.FullServiceAccountName != "" &&
+		fileExists &&
+		isKeyVerificationDue(secret) {
+
+		log.Debug().Msgf("[%v] Secret %v.%v - Verifying key for service account %v is still active...", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName)
+
+		reason, err := getKeyMismatchReason(iamService, currentState, keyfileData)
+		if err != nil {
+			keyVerificationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			return false, err
+		}
+
+		// only a completed check counts, so a failing api call is retried on the next reconcile instead of after the verification interval
+		recordKeyVerification(secret)
+
+		if reason != "" {
+			log.Warn().Msgf("[%v] Secret %v.%v - Key stored in secret %v, reissuing it now...", initiator, secret.Name, secret.Namespace, reason)
+			keyVerificationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "mismatched", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			return true, nil
+		}
+
+		keyVerificationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+		return false, nil
+	}
+
+	keyVerificationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "skipped", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+
+	return false, nil
+}
+
+// getKeyMismatchReason returns why the keyfile stored in a secret can't be used for the managed service account, or an empty string if it can
+func getKeyMismatchReason(iamService *GoogleCloudIAMService, currentState *GCPServiceAccountState, keyfileData []byte) (reason string, err error) {
+
+	keyfile, err := parseServiceAccountKeyfile(keyfileData)
+	if err != nil {
+		return fmt.Sprintf("can't be parsed: %v", err), nil
+	}
+
+	_, serviceAccountEmail, err := getProjectIDAndServiceAccountEmail(currentState.FullServiceAccountName)
+	if err != nil {
+		return
+	}
+	if keyfile.ClientEmail != serviceAccountEmail {
+		return fmt.Sprintf("belongs to %v instead of %v", keyfile.ClientEmail, serviceAccountEmail), nil
+	}
+
+	if _, disabled := currentState.DisabledKeys[keyfile.PrivateKeyID]; disabled {
+		return fmt.Sprintf("has key id %v which has been disabled", keyfile.PrivateKeyID), nil
+	}
+
+	exists, disabled, err := iamService.GetServiceAccountKeyStatus(currentState.FullServiceAccountName, keyfile.PrivateKeyID)
+	if err != nil {
+		return
+	}
+	if !exists {
+		return fmt.Sprintf("has key id %v which doesn't exist anymore", keyfile.PrivateKeyID), nil
+	}
+	if disabled {
+		return fmt.Sprintf("has key id %v which has been disabled outside of this controller", keyfile.PrivateKeyID), nil
+	}
+
+	return "", nil
+}
+
+// isKeyVerificationDue returns true if the key of a secret hasn't been verified successfully within the verification interval
+func isKeyVerificationDue(secret *v1.Secret) bool {
+
+	lastKeyVerificationsMutex.Lock()
+	defer lastKeyVerificationsMutex.Unlock()
+
+	lastVerified, ok := lastKeyVerifications[secret.Namespace+"/"+secret.Name]
+
+	return !ok || time.Since(lastVerified).Minutes() >= float64(*keyVerificationIntervalMinutes)
+}
+
+// isDeferralReportDue returns true and records the report if a deferred rotation or purge hasn't been reported within the last 15 minutes, to limit the number of calls to the iam and kubernetes apis while a maintenance window is closed
+func isDeferralReportDue(key string, now time.Time) bool {
+
+	lastDeferralReportsMutex.Lock()
+	defer lastDeferralReportsMutex.Unlock()
+
+	if lastReported, ok := lastDeferralReports[key]; ok && now.Sub(lastReported).Minutes() < 15 {
+		return false
+	}
+	lastDeferralReports[key] = now
+
+	return true
+}
+
+// recordKeyVerification stores when the key of a secret has last been verified
+func recordKeyVerification(secret *v1.Secret) {
+
+	lastKeyVerificationsMutex.Lock()
+	defer lastKeyVerificationsMutex.Unlock()
+
+	lastKeyVerifications[secret.Namespace+"/"+secret.Name] = time.Now()
+}
+
+func makeSecretChangesRotateKeys(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, lastAttempt, lastRenewed time.Time, newAccount, forceRotation bool) (err error) {
+
+	filename := desiredState.Filename
+	if filename == "" {
+		filename = "service-account-key.json"
+	}
+	fileExists := false
+	if len(secret.Data) > 0 {
+		_, fileExists = secret.Data[filename]
+	}
+	hmacKeyMissing := false
+	if desiredState.HmacKeys {
+		_, hmacKeyExists := secret.Data["hmac-access-id"]
+		hmacKeyMissing = !hmacKeyExists
+	}
+
+	// a rotation is requested by setting the rotate-now annotation to a token that differs from the last served one, so repeated applies of the same manifest don't rotate again
+	rotateNowRequested := desiredState.RotateNowToken != "" && desiredState.RotateNowToken != currentState.ServedRotateNowToken
+
+	// scheduled rotations only happen after a per-secret jitter, within the maintenance windows and within the rotation budget; missing keys, dead keys and requested rotations are handled right away
+	secretKey := secret.Namespace + "/" + secret.Name
+	rotationDeadline := getRotationDeadline(lastRenewed, desiredState.KeyRotationAfterHours, *rotationJitterPercentage, secretKey)
+	rotationDue := time.Now().After(rotationDeadline)
+	scheduledRotation := rotationDue && fileExists && !newAccount && !hmacKeyMissing && !forceRotation && !rotateNowRequested &&
+		desiredState.Enabled == "true" &&
+		desiredState.Name != "" &&
+		currentState.FullServiceAccountName != "" &&
+		(!*allowDisableKeyRotationOverride || !desiredState.DisableKeyRotation)
+	if scheduledRotation && time.Since(lastAttempt).Minutes() > 15 {
+		windowOpen, nextWindow := getMaintenanceWindowStatus(desiredState, time.Now())
+		if !windowOpen {
+			if isDeferralReportDue("rotation/"+secretKey, time.Now()) {
+				log.Info().Msgf("[%v] Secret %v.%v - Service account %v key is up for rotation, but deferring it to the next maintenance window at %v...", initiator, secret.Name, secret.Namespace, desiredState.Name, nextWindow.Format(time.RFC3339))
+				_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeNormal, "RotationDeferred", fmt.Sprintf("Service account %v key is up for rotation, but it's deferred to the next maintenance window at %v", desiredState.Name, nextWindow.Format(time.RFC3339)))
+			}
+			rotationDue = false
+		} else if !rotationBudget.Acquire(secretKey, rotationDeadline, time.Now()) {
+			log.Info().Msgf("[%v] Secret %v.%v - Service account %v key is up for rotation, but the rotation budget of %v per hour is used up; queueing it...", initiator, secret.Name, secret.Namespace, desiredState.Name, *maxRotationsPerHour)
+			rotationDue = false
+		}
+		keyRotationBacklog.Set(float64(rotationBudget.BacklogSize()))
+	} else if !scheduledRotation {
+		rotationBudget.Remove(secretKey)
+		keyRotationBacklog.Set(float64(rotationBudget.BacklogSize()))
+	}
+
+	// when hmac keys get enabled for a secret that already has a valid key only the hmac key is issued, so the json key isn't rotated ahead of schedule
+	if (*mode == "normal" || *mode == "convenient" || *mode == "rotate_keys_only") &&
+		desiredState.Enabled == "true" &&
+		desiredState.Name != "" &&
+		time.Since(lastAttempt).Minutes() > 15 &&
+		currentState.FullServiceAccountName != "" &&
+		hmacKeyMissing && fileExists && !newAccount && !rotationDue && !forceRotation && !rotateNowRequested {
+
+		log.Info().Msgf("[%v] Secret %v.%v - Service account %v has no hmac key yet, requesting one now...", initiator, secret.Name, secret.Namespace, desiredState.Name)
+
+		// 'lock' the secret for 15 minutes by storing the last attempt timestamp to prevent hitting the rate limit if the api call fails
+		currentState.LastAttempt = time.Now().Format(time.RFC3339)
+
+		err = updateSecret(kubeClientset, secret, *currentState, initiator)
+		if err != nil {
+			keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			return
+		}
+
+		err = issueHmacKey(kubeClientset, iamService, secret, initiator, currentState)
+		if err != nil {
+			keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			return err
+		}
+
+		log.Info().Msgf("[%v] Secret %v.%v - Service account hmac key has been issued successfully...", initiator, secret.Name, secret.Namespace)
+
+		keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+
+		return nil
+	}
+
+	// check if gcp-service-account is enabled for this secret, and a service account doesn't already exist
+	if (*mode == "normal" || *mode == "convenient" || *mode == "rotate_keys_only") &&
+		desiredState.Enabled == "true" &&
+		desiredState.Name != "" &&
+		(time.Since(lastAttempt).Minutes() > 15 || newAccount) &&
+		(!fileExists || !*allowDisableKeyRotationOverride || !desiredState.DisableKeyRotation || forceRotation || rotateNowRequested) &&
+		currentState.FullServiceAccountName != "" &&
+		(rotationDue || !fileExists || newAccount || forceRotation || rotateNowRequested) {
+
+		if rotateNowRequested {
+			log.Info().Msgf("[%v] Secret %v.%v - Service account %v key rotation has been requested with token %v, requesting a new one now...", initiator, secret.Name, secret.Namespace, desiredState.Name, desiredState.RotateNowToken)
+		} else {
+			log.Info().Msgf("[%v] Secret %v.%v - Service account %v key is up for rotation, requesting a new one now...", initiator, secret.Name, secret.Namespace, desiredState.Name)
+		}
+
+		if !newAccount {
+			// 'lock' the secret for 15 minutes by storing the last attempt timestamp to prevent hitting the rate limit if the Google Cloud IAM api call fails and to prevent the watcher and the fallback polling to operate on the secret at the same time
+			currentState.LastAttempt = time.Now().Format(time.RFC3339)
+
+			err = updateSecret(kubeClientset, secret, *currentState, initiator)
+			if err != nil {
+				keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+				return
+			}
+		}
+
+		// record the served token in the same update as the new key
+		servedRotateNowToken := currentState.ServedRotateNowToken
+		if rotateNowRequested {
+			currentState.ServedRotateNowToken = desiredState.RotateNowToken
+		}
+
+		err = issueServiceAccountKey(kubeClientset, iamService, secret, initiator, desiredState, currentState, desiredState.KeepPreviousKey)
+		if err != nil {
+			currentState.ServedRotateNowToken = servedRotateNowToken
+			keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			return err
+		}
+
+		log.Info().Msgf("[%v] Secret %v.%v - Service account keyfile has been renewed successfully...", initiator, secret.Name, secret.Namespace)
+
+		keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+
+		return nil
+	}
+
+	keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "skipped", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+
+	return nil
+}
+
+// issueServiceAccountKey creates and verifies a new key and stores it - together with all outputs derived from it - in the secret in a single update
+func issueServiceAccountKey(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, keepPreviousKey bool) (err error) {
+
+	filename := desiredState.Filename
+	if filename == "" {
+		filename = "service-account-key.json"
+	}
+
+	// create service account key
+	serviceAccountKey, err := createServiceAccountKey(kubeClientset, iamService, secret, initiator, desiredState, currentState)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed creating service account %v key", currentState.FullServiceAccountName)
+		return err
+	}
+
+	// delete the new keys if they don't end up in the secret, because purging only deletes keys recorded as issued
+	hmacAccessID, hmacSecret := "", ""
+	previousHmacAccessID := currentState.HmacAccessID
+	defer func() {
+		if err != nil {
+			log.Warn().Msgf("[%v] Secret %v.%v - Deleting new key %v because it hasn't been stored...", initiator, secret.Name, secret.Namespace, serviceAccountKey.Name)
+			if _, deleteErr := iamService.deleteServiceAccountKey(serviceAccountKey); deleteErr != nil {
+				log.Error().Err(deleteErr).Msgf("Failed deleting unstored key %v", serviceAccountKey.Name)
+			}
+			currentState.ActiveKeyIDs = removeFromStringArray(currentState.ActiveKeyIDs, getKeyID(serviceAccountKey.Name))
+			currentState.IssuedKeyIDs = removeFromStringArray(currentState.IssuedKeyIDs, getKeyID(serviceAccountKey.Name))
+
+			if hmacAccessID != "" {
+				deleteUnstoredHmacKey(iamService, secret, initiator, currentState, hmacAccessID, previousHmacAccessID)
+			}
+		}
+	}()
+
+	decodedPrivateKeyData, err := base64.StdEncoding.DecodeString(serviceAccountKey.PrivateKeyData)
+	if err != nil {
+		log.Error().Err(err)
+		return err
+	}
+
+	// verify the new key before storing it, so a corrupted or mismatched key never replaces a working one
+	err = verifyServiceAccountKey(iamService, currentState.FullServiceAccountName, serviceAccountKey, decodedPrivateKeyData)
+	if err != nil {
+		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Verifying new key %v failed", initiator, secret.Name, secret.Namespace, serviceAccountKey.Name)
+		return err
+	}
+
+	// create hmac key for s3-compatible clients
+	if desiredState.HmacKeys {
+		hmacAccessID, hmacSecret, err = iamService.CreateHmacKey(currentState.FullServiceAccountName)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed creating service account %v hmac key", currentState.FullServiceAccountName)
+			return err
+		}
+	}
+
+	// reload secret to avoid object has been modified error
+	secret, err = kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Error().Err(err)
+		return err
+	}
+
+	// update the secret
+	currentState.LastRenewed = time.Now().Format(time.RFC3339)
+	currentState.Filename = filename
+
+	// store the key file
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+
+	// service account keyfile
+	if previousKeyfile, ok := secret.Data[filename]; ok && keepPreviousKey {
+		// keep the previous key until it gets purged, for consumers that cache the file or reload slowly
+		secret.Data[filename+".previous"] = previousKeyfile
+	} else {
+		delete(secret.Data, filename+".previous")
+	}
+	secret.Data[filename] = decodedPrivateKeyData
+	currentState.KeepPreviousKey = keepPreviousKey
+	currentState.ActiveKeyIDs = append(currentState.ActiveKeyIDs, getKeyID(serviceAccountKey.Name))
+	currentState.IssuedKeyIDs = append(currentState.IssuedKeyIDs, getKeyID(serviceAccountKey.Name))
+
+	// separate fields of the keyfile for applications reading them as environment variables
+	if desiredState.DerivedFields {
+		derivedData, err := getDerivedSecretData(decodedPrivateKeyData, serviceAccountKey.ValidAfterTime)
+		if err != nil {
+			log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed deriving fields from service account keyfile", initiator, secret.Name, secret.Namespace)
+			return err
+		}
+		for key, value := range derivedData {
+			secret.Data[key] = value
+		}
+	} else if currentState.DerivedFields {
+		removeDerivedSecretData(secret.Data)
+	}
+	currentState.DerivedFields = desiredState.DerivedFields
+
+	// hmac access id and secret
+	if desiredState.HmacKeys {
+		secret.Data["hmac-access-id"] = []byte(hmacAccessID)
+		secret.Data["hmac-secret"] = []byte(hmacSecret)
+	}
+	currentState.HmacKeys = desiredState.HmacKeys
+	currentState.HmacAccessID = hmacAccessID
+	if hmacAccessID != "" {
+		currentState.IssuedHmacAccessIDs = append(currentState.IssuedHmacAccessIDs, hmacAccessID)
+	}
+
+	// docker config json for using the secret as image pull secret
+	if len(desiredState.DockerRegistries) > 0 {
+		warnIfNotDockerConfigSecret(kubeClientset, secret, initiator)
+		dockerConfigJSON, err := getDockerConfigJSON(decodedPrivateKeyData, desiredState.DockerRegistries)
+		if err != nil {
+			log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed generating docker config json from service account keyfile", initiator, secret.Name, secret.Namespace)
+			return err
+		}
+		secret.Data[v1.DockerConfigJsonKey] = dockerConfigJSON
+	}
+	currentState.DockerRegistries = desiredState.DockerRegistries
+
+	// rendered templates are written in the same update as the keyfile so consumers never see a half-updated secret
+	renderedData, err := renderSecretTemplates(desiredState.Templates, getReservedSecretKeys(filename), decodedPrivateKeyData, serviceAccountKey.ValidAfterTime, desiredState.Name, currentState.FullServiceAccountName, secret.Namespace, secret.Name)
+	if err != nil {
+		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed rendering templates for service account keyfile", initiator, secret.Name, secret.Namespace)
+		return err
+	}
+	currentState.TemplateKeys = setRenderedTemplates(secret.Data, renderedData, currentState.TemplateKeys, getReservedSecretKeys(filename))
+	currentState.TemplatesChecksum = getTemplatesChecksum(desiredState.Templates)
+
+	err = updateSecret(kubeClientset, secret, *currentState, initiator)
+	if err != nil {
+		return err
+	}
+
+	// a failed restart doesn't fail the rotation, since the new key is already stored
+	if desiredState.RestartWorkloads {
+		restartErr := restartConsumerWorkloads(kubeClientset, secret, initiator, getKeyID(serviceAccountKey.Name))
+		if restartErr != nil {
+			log.Error().Err(restartErr).Msgf("[%v] Secret %v.%v - Failed restarting workloads consuming the secret", initiator, secret.Name, secret.Namespace)
+		}
+	}
+
+	return nil
+}
+
+// makeSecretChangesSyncOutputs writes the outputs derived from the key already stored in the secret once they've been enabled or changed, instead of waiting for the next rotation
+func makeSecretChangesSyncOutputs(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, lastAttempt time.Time) (err error) {
+
+	filename := currentState.Filename
+	if filename == "" {
+		filename = "service-account-key.json"
+	}
+	_, fileExists := secret.Data[filename]
+
+	if (*mode == "normal" || *mode == "convenient" || *mode == "rotate_keys_only") &&
+		desiredState.Enabled == "true" &&
+		currentState.FullServiceAccountName != "" &&
+		fileExists &&
+		time.Since(lastAttempt).Minutes() > 15 &&
+		secretOutputsChanged(desiredState, *currentState) {
+
+		log.Info().Msgf("[%v] Secret %v.%v - Outputs of service account %v key have changed, writing them from the current key...", initiator, secret.Name, secret.Namespace, desiredState.Name)
+
+		// 'lock' the secret for 15 minutes by storing the last attempt timestamp to prevent retrying a failing change on every reconcile
+		currentState.LastAttempt = time.Now().Format(time.RFC3339)
+
+		err = updateSecret(kubeClientset, secret, *currentState, initiator)
+		if err != nil {
+			return
+		}
+
+		// reload secret to avoid object has been modified error
+		secret, err = kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+		if err != nil {
+			log.Error().Err(err)
+			return err
+		}
+
+		keyfileData, ok := secret.Data[filename]
+		if !ok {
+			return fmt.Errorf("Secret %v.%v no longer has a %v entry", secret.Name, secret.Namespace, filename)
+		}
+
+		// the creation time of the key isn't part of the keyfile, but used by the derived fields and templates
+		keyCreatedAt := ""
+		if desiredState.DerivedFields || len(desiredState.Templates) > 0 {
+			keyfile, err := parseServiceAccountKeyfile(keyfileData)
+			if err != nil {
+				return err
+			}
+			keyCreatedAt, err = iamService.GetServiceAccountKeyCreatedAt(currentState.FullServiceAccountName, keyfile.PrivateKeyID)
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed retrieving service account %v key %v", currentState.FullServiceAccountName, keyfile.PrivateKeyID)
+				return err
+			}
+		}
+
+		// separate fields of the keyfile for applications reading them as environment variables
+		if desiredState.DerivedFields {
+			derivedData, err := getDerivedSecretData(keyfileData, keyCreatedAt)
+			if err != nil {
+				log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed deriving fields from service account keyfile", initiator, secret.Name, secret.Namespace)
+				return err
+			}
+			for key, value := range derivedData {
+				secret.Data[key] = value
+			}
+		} else if currentState.DerivedFields {
+			removeDerivedSecretData(secret.Data)
+		}
+		currentState.DerivedFields = desiredState.DerivedFields
+
+		// docker config json for using the secret as image pull secret; it isn't removed when the registries are, because secrets of type kubernetes.io/dockerconfigjson require it
+		if len(desiredState.DockerRegistries) > 0 {
+			warnIfNotDockerConfigSecret(kubeClientset, secret, initiator)
+			dockerConfigJSON, err := getDockerConfigJSON(keyfileData, desiredState.DockerRegistries)
+			if err != nil {
+				log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed generating docker config json from service account keyfile", initiator, secret.Name, secret.Namespace)
+				return err
+			}
+			secret.Data[v1.DockerConfigJsonKey] = dockerConfigJSON
+		}
+		currentState.DockerRegistries = desiredState.DockerRegistries
+
+		// templates are rendered again whenever they change, and the entries of removed templates are removed from the secret
+		renderedData, err := renderSecretTemplates(desiredState.Templates, getReservedSecretKeys(filename), keyfileData, keyCreatedAt, desiredState.Name, currentState.FullServiceAccountName, secret.Namespace, secret.Name)
 		if err != nil {
-			serviceAccountRetrieveTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
-			return false, err
+			log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed rendering templates for service account keyfile", initiator, secret.Name, secret.Namespace)
+			return err
 		}
+		currentState.TemplateKeys = setRenderedTemplates(secret.Data, renderedData, currentState.TemplateKeys, getReservedSecretKeys(filename))
+		currentState.TemplatesChecksum = getTemplatesChecksum(desiredState.Templates)
 
-		log.Info().Msgf("[%v] Secret %v.%v - Service account name has been stored in secret successfully...", initiator, secret.Name, secret.Namespace)
+		return updateSecret(kubeClientset, secret, *currentState, initiator)
+	}
 
-		serviceAccountRetrieveTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+	return nil
+}
 
-		return true, nil
-	}
+// secretOutputsChanged returns true if the outputs derived from the key differ from the ones written with the key currently in the secret
+func secretOutputsChanged(desiredState, currentState GCPServiceAccountState) bool {
+	return desiredState.DerivedFields != currentState.DerivedFields ||
+		!stringArraysEqual(desiredState.DockerRegistries, currentState.DockerRegistries) ||
+		getTemplatesChecksum(desiredState.Templates) != currentState.TemplatesChecksum
+}
 
-	// check if gcp-service-account is enabled for this secret, and a service account doesn't already exist
-	if (*mode == "normal" || *mode == "convenient") && desiredState.Enabled == "true" && desiredState.Name != "" && time.Since(lastAttempt).Minutes() > 15 && currentState.FullServiceAccountName == "" {
+// warnIfNotDockerConfigSecret records a warning event if docker config json is written to a secret that can't be used as image pull secret
+func warnIfNotDockerConfigSecret(kubeClientset *kubernetes.Clientset, secret *v1.Secret, initiator string) {
+	if secret.Type != v1.SecretTypeDockerConfigJson {
+		log.Warn().Msgf("[%v] Secret %v.%v - Secret is of type %v instead of %v and can't be used as image pull secret", initiator, secret.Name, secret.Namespace, secret.Type, v1.SecretTypeDockerConfigJson)
+		_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "InvalidSecretType", fmt.Sprintf("Secret is of type %v instead of %v, so the %v entry written for the docker registries can't be used to pull images; recreate it with type %v", secret.Type, v1.SecretTypeDockerConfigJson, v1.DockerConfigJsonKey, v1.SecretTypeDockerConfigJson))
+	}
+}
 
-		log.Info().Msgf("[%v] Secret %v.%v - Service account %v hasn't been created yet, creating one now...", initiator, secret.Name, secret.Namespace, desiredState.Name)
+// issueHmacKey creates a hmac key and stores it in the secret without touching the service account keyfile
+func issueHmacKey(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, currentState *GCPServiceAccountState) (err error) {
 
-		// 'lock' the secret for 15 minutes by storing the last attempt timestamp to prevent hitting the rate limit if the Google Cloud IAM api call fails and to prevent the watcher and the fallback polling to operate on the secret at the same time
-		currentState.LastAttempt = time.Now().Format(time.RFC3339)
+	hmacAccessID, hmacSecret, err := iamService.CreateHmacKey(currentState.FullServiceAccountName)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed creating service account %v hmac key", currentState.FullServiceAccountName)
+		return err
+	}
 
-		err = updateSecret(kubeClientset, secret, *currentState, initiator)
+	// delete the new key if it doesn't end up in the secret, because purging only deletes keys recorded as issued
+	previousHmacAccessID := currentState.HmacAccessID
+	defer func() {
 		if err != nil {
-			serviceAccountCreateTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
-			return
+			deleteUnstoredHmacKey(iamService, secret, initiator, currentState, hmacAccessID, previousHmacAccessID)
 		}
+	}()
 
-		// create service account
-		fullServiceAccountName, err := iamService.CreateServiceAccount(desiredState.Name)
-		if err != nil {
-			log.Error().Err(err).Msgf("Failed creating service account %v", desiredState.Name)
-			serviceAccountCreateTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
-			return false, err
-		}
+	// reload secret to avoid object has been modified error
+	secret, err = kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Error().Err(err)
+		return err
+	}
 
-		// reload secret to avoid object has been modified error
-		secret, err = kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
-		if err != nil {
-			log.Error().Err(err)
-			return false, err
-		}
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	secret.Data["hmac-access-id"] = []byte(hmacAccessID)
+	secret.Data["hmac-secret"] = []byte(hmacSecret)
+	currentState.HmacKeys = true
+	currentState.HmacAccessID = hmacAccessID
+	currentState.IssuedHmacAccessIDs = append(currentState.IssuedHmacAccessIDs, hmacAccessID)
 
-		// update the secret
-		currentState.Enabled = desiredState.Enabled
-		currentState.Name = desiredState.Name
-		currentState.FullServiceAccountName = fullServiceAccountName
+	return updateSecret(kubeClientset, secret, *currentState, initiator)
+}
 
-		log.Info().Msgf("[%v] Secret %v.%v - Updating secret because a new service account has been created...", initiator, secret.Name, secret.Namespace)
+// deleteUnstoredHmacKey deletes a new hmac key that couldn't be stored in the secret and restores the access id of the stored one in the state
+func deleteUnstoredHmacKey(iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, currentState *GCPServiceAccountState, hmacAccessID, previousHmacAccessID string) {
 
-		err = updateSecret(kubeClientset, secret, *currentState, initiator)
-		if err != nil {
-			serviceAccountCreateTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
-			return false, err
+	log.Warn().Msgf("[%v] Secret %v.%v - Deleting new hmac key %v because it hasn't been stored...", initiator, secret.Name, secret.Namespace, hmacAccessID)
+	if deleteErr := iamService.DeleteHmacKey(currentState.FullServiceAccountName, hmacAccessID); deleteErr != nil {
+		log.Error().Err(deleteErr).Msgf("Failed deleting unstored hmac key %v", hmacAccessID)
+	}
+	currentState.HmacAccessID = previousHmacAccessID
+	currentState.IssuedHmacAccessIDs = removeFromStringArray(currentState.IssuedHmacAccessIDs, hmacAccessID)
+}
+
+// createServiceAccountKey creates a new key and, if the account has reached its key limit, evicts a key issued by this controller and tries again, unless consumer aware purging holds it
+func createServiceAccountKey(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState) (serviceAccountKey *iam.ServiceAccountKey, err error) {
+
+	serviceAccountKey, err = iamService.CreateServiceAccountKey(currentState.FullServiceAccountName)
+	if err == nil || !isKeyLimitError(err) {
+		return
+	}
+
+	// evicting a key pulls it from under the consumers just like purging does, so it's held the same way
+	if desiredState.ConsumerAwarePurge {
+		lastRenewed, _ := time.Parse(time.RFC3339, currentState.LastRenewed)
+		stalePods, listErr := listStaleConsumerPods(kubeClientset, secret, desiredState.Filename, lastRenewed)
+		if listErr != nil {
+			log.Error().Err(listErr).Msgf("[%v] Secret %v.%v - Failed listing pods consuming the secret", initiator, secret.Name, secret.Namespace)
+			return
 		}
+		if len(stalePods) > 0 {
+			log.Warn().Msgf("[%v] Secret %v.%v - Service account %v has reached its key limit, but pods %v haven't picked up the current key yet, holding evicting keys...", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName, strings.Join(stalePods, ", "))
+			_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "KeyEvictionHeld", fmt.Sprintf("Service account %v has reached its key limit, but no key is evicted to make room for a new one until pods %v have picked up the current key", currentState.FullServiceAccountName, strings.Join(stalePods, ", ")))
+			keyEvictionTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "held", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			return
+		}
+	}
 
-		log.Info().Msgf("[%v] Secret %v.%v - Service account name has been stored in secret successfully...", initiator, secret.Name, secret.Namespace)
+	log.Warn().Err(err).Msgf("[%v] Secret %v.%v - Service account %v has reached its key limit, evicting a key...", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName)
 
-		serviceAccountCreateTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+	// never evict the key currently stored in the secret, the previous key kept next to it or the keys retained with the reenable-keys annotation
+	filename := desiredState.Filename
+	if filename == "" {
+		filename = "service-account-key.json"
+	}
+	protectedKeyIDs := append([]string{}, getRetainedKeyIDs(desiredState, *currentState)...)
+	for _, keyfileName := range []string{filename, filename + ".previous"} {
+		if keyfile, parseErr := parseServiceAccountKeyfile(secret.Data[keyfileName]); parseErr == nil {
+			protectedKeyIDs = append(protectedKeyIDs, keyfile.PrivateKeyID)
+		}
+	}
 
-		return true, nil
+	evictedKeyID, evictErr := iamService.EvictOldestServiceAccountKey(currentState.FullServiceAccountName, currentState.IssuedKeyIDs, protectedKeyIDs, currentState.DisabledKeys, desiredState.PurgeKeysAfterHours)
+	if evictErr != nil {
+		log.Error().Err(evictErr).Msgf("[%v] Secret %v.%v - Failed evicting key for service account %v", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName)
+		keyEvictionTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+		return
 	}
 
-	serviceAccountRetrieveTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "skipped", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
-	serviceAccountCreateTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "skipped", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+	keyEvictionTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
 
-	return false, nil
+	currentState.IssuedKeyIDs = removeFromStringArray(currentState.IssuedKeyIDs, evictedKeyID)
+	currentState.ActiveKeyIDs = removeFromStringArray(currentState.ActiveKeyIDs, evictedKeyID)
+	delete(currentState.DisabledKeys, evictedKeyID)
+
+	return iamService.CreateServiceAccountKey(currentState.FullServiceAccountName)
 }
 
-func makeSecretChangesSetPermissions(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, lastAttempt, lastRenewed time.Time, newAccount bool) (err error) {
+// removeFromStringArray returns the array without any occurrences of the value
+func removeFromStringArray(array []string, value string) (result []string) {
+	for _, item := range array {
+		if item != value {
+			result = append(result, item)
+		}
+	}
 
-	// check if gcp-service-account is enabled for this secret, and permissions have been defined
-	if (*mode == "convenient") && desiredState.Enabled == "true" && desiredState.Name != "" && (time.Since(lastAttempt).Minutes() > 15 || newAccount) && currentState.FullServiceAccountName == "" && len(currentState.Permissions) != len(desiredState.Permissions) {
-		// in convenient mode this controller can set the permissions as well; but awarding this controller with the possibility to set permissions is not without risk
+	return
+}
 
-		err = iamService.SetServiceAccountRoleBinding(currentState.FullServiceAccountName, desiredState.Permissions)
-		if err != nil {
-			log.Warn().Err(err).Msgf("Setting permissions for service account %v failed", desiredState.Name)
+// stringArraysEqual returns true if both arrays have the same items in the same order
+func stringArraysEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
 		}
 	}
 
-	return nil
+	return true
 }
 
-func makeSecretChangesRotateKeys(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, lastAttempt, lastRenewed time.Time, newAccount bool) (err error) {
+// verifyServiceAccountKey checks a newly created key against the managed account and the public key registered for it
+func verifyServiceAccountKey(iamService *GoogleCloudIAMService, fullServiceAccountName string, serviceAccountKey *iam.ServiceAccountKey, keyfileData []byte) (err error) {
 
-	filename := desiredState.Filename
-	if filename == "" {
-		filename = "service-account-key.json"
+	_, serviceAccountEmail, err := getProjectIDAndServiceAccountEmail(fullServiceAccountName)
+	if err != nil {
+		return
 	}
-	fileExists := false
-	if len(secret.Data) > 0 {
-		_, fileExists = secret.Data[filename]
+
+	publicKeyPEM, err := iamService.GetServiceAccountPublicKey(serviceAccountKey.Name)
+	if err != nil {
+		return
 	}
 
-	// check if gcp-service-account is enabled for this secret, and a service account doesn't already exist
+	return verifyServiceAccountKeyfile(keyfileData, serviceAccountEmail, getKeyID(serviceAccountKey.Name), publicKeyPEM)
+}
+
+func makeSecretChangesPurgeKeys(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, lastAttempt, lastRenewed time.Time) (err error) {
+
 	if (*mode == "normal" || *mode == "convenient" || *mode == "rotate_keys_only") &&
-		desiredState.Enabled == "true" &&
-		desiredState.Name != "" &&
-		(time.Since(lastAttempt).Minutes() > 15 || newAccount) &&
-		(!fileExists || !*allowDisableKeyRotationOverride || !desiredState.DisableKeyRotation) &&
+		time.Since(lastAttempt).Minutes() > 15 &&
+		currentState.Enabled == "true" &&
+		currentState.LastRenewed != "" &&
+		time.Since(lastRenewed).Hours() > 2 &&
 		currentState.FullServiceAccountName != "" &&
-		time.Since(lastRenewed).Hours() > float64(*keyRotationAfterHours) {
+		(!*allowDisableKeyRotationOverride || !desiredState.DisableKeyRotation) {
 
-		log.Info().Msgf("[%v] Secret %v.%v - Service account %v key is up for rotation, requesting a new one now...", initiator, secret.Name, secret.Namespace, desiredState.Name)
+		windowOpen, nextWindow := getMaintenanceWindowStatus(desiredState, time.Now())
+		if !windowOpen {
+			log.Debug().Msgf("[%v] Secret %v.%v - Deferring purging keys for %v to the next maintenance window at %v...", initiator, secret.Name, secret.Namespace, currentState.Name, nextWindow.Format(time.RFC3339))
 
-		if !newAccount {
-			// 'lock' the secret for 15 minutes by storing the last attempt timestamp to prevent hitting the rate limit if the Google Cloud IAM api call fails and to prevent the watcher and the fallback polling to operate on the secret at the same time
-			currentState.LastAttempt = time.Now().Format(time.RFC3339)
+			if !isDeferralReportDue("purge/"+secret.Namespace+"/"+secret.Name, time.Now()) {
+				return nil
+			}
 
-			err = updateSecret(kubeClientset, secret, *currentState, initiator)
+			// only report the deferral if there's actually something to purge
+			hasPurgeEligibleKeys, err := iamService.HasPurgeEligibleKeys(currentState.FullServiceAccountName, desiredState.PurgeKeysAfterHours, currentState.IssuedKeyIDs, getRetainedKeyIDs(desiredState, *currentState))
 			if err != nil {
-				keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
-				return
+				log.Error().Err(err).Msgf("Failed checking service account %v for keys to purge", currentState.FullServiceAccountName)
+				return err
 			}
+			if hasPurgeEligibleKeys {
+				_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeNormal, "PurgeDeferred", fmt.Sprintf("Service account %v has keys up for purging, but purging is deferred to the next maintenance window at %v", currentState.Name, nextWindow.Format(time.RFC3339)))
+			}
+			return nil
 		}
 
-		// create service account
-		serviceAccountKey, err := iamService.CreateServiceAccountKey(currentState.FullServiceAccountName)
+		// hold purging old keys until every running pod consuming the secret uses the new key, but only if there are keys to purge at all
+		if desiredState.ConsumerAwarePurge {
+			stalePods, err := listStaleConsumerPods(kubeClientset, secret, desiredState.Filename, lastRenewed)
+			if err != nil {
+				log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed listing pods consuming the secret", initiator, secret.Name, secret.Namespace)
+				return err
+			}
+			hasPurgeEligibleKeys := false
+			if len(stalePods) > 0 {
+				hasPurgeEligibleKeys, err = iamService.HasPurgeEligibleKeys(currentState.FullServiceAccountName, desiredState.PurgeKeysAfterHours, currentState.IssuedKeyIDs, getRetainedKeyIDs(desiredState, *currentState))
+				if err != nil {
+					log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed checking %v for keys to purge", initiator, secret.Name, secret.Namespace, currentState.Name)
+					return err
+				}
+			}
+			if hasPurgeEligibleKeys {
+				if time.Since(lastRenewed).Hours() > float64(*consumerPickupDeadlineHours) {
+					log.Warn().Msgf("[%v] Secret %v.%v - Pods %v haven't picked up the new key within %v hours, holding purging keys for %v...", initiator, secret.Name, secret.Namespace, strings.Join(stalePods, ", "), *consumerPickupDeadlineHours, currentState.Name)
+					_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "ConsumersNotUpdated", fmt.Sprintf("Pods %v haven't picked up the new key within %v hours after rotation; old keys aren't purged until they restart", strings.Join(stalePods, ", "), *consumerPickupDeadlineHours))
+					keyPurgeHoldTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "overdue", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+				} else {
+					log.Info().Msgf("[%v] Secret %v.%v - Waiting for pods %v to pick up the new key before purging keys for %v...", initiator, secret.Name, secret.Namespace, strings.Join(stalePods, ", "), currentState.Name)
+					keyPurgeHoldTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "waiting", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+				}
+				return nil
+			}
+		}
+
+		log.Info().Msgf("[%v] Secret %v.%v - Checking %v for keys to purge...", initiator, secret.Name, secret.Namespace, currentState.Name)
+
+		// 'lock' the secret for 15 minutes by storing the last attempt timestamp to prevent hitting the rate limit if the Google Cloud IAM api call fails and to prevent the watcher and the fallback polling to operate on the secret at the same time
+		currentState.LastAttempt = time.Now().Format(time.RFC3339)
+
+		err = updateSecret(kubeClientset, secret, *currentState, initiator)
 		if err != nil {
-			log.Error().Err(err).Msgf("Failed creating service account %v key", currentState.FullServiceAccountName)
-			keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			keyPurgeTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
 			return err
 		}
 
-		// reload secret to avoid object has been modified error
-		secret, err = kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+		// secrets that were managed before key ids were tracked adopt the key currently stored in the secret
+		filename := currentState.Filename
+		if filename == "" {
+			filename = "service-account-key.json"
+		}
+		if len(currentState.IssuedKeyIDs) == 0 {
+			if keyfile, err := parseServiceAccountKeyfile(secret.Data[filename]); err == nil {
+				currentState.IssuedKeyIDs = []string{keyfile.PrivateKeyID}
+			}
+		}
+
+		// purge old service account keys, except the ones that have been re-enabled
+		purgeResult, err := iamService.PurgeServiceAccountKeys(currentState.FullServiceAccountName, desiredState.PurgeKeysAfterHours, *disableKeysObservationHours, currentState.IssuedKeyIDs, getRetainedKeyIDs(desiredState, *currentState), currentState.DisabledKeys)
 		if err != nil {
-			log.Error().Err(err)
+			log.Error().Err(err).Msgf("Failed purging service account %v keys", currentState.FullServiceAccountName)
+			keyPurgeTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
 			return err
 		}
 
-		// update the secret
-		currentState.LastRenewed = time.Now().Format(time.RFC3339)
-		currentState.Filename = filename
+		// secrets that were managed before hmac access ids were tracked adopt the hmac key currently stored in the secret
+		if len(currentState.IssuedHmacAccessIDs) == 0 && currentState.HmacAccessID != "" {
+			currentState.IssuedHmacAccessIDs = []string{currentState.HmacAccessID}
+		}
 
-		// store the key file
-		if secret.Data == nil {
-			secret.Data = make(map[string][]byte)
+		// purge old hmac keys issued by this controller on the same schedule, but never the one stored in the secret
+		if len(currentState.IssuedHmacAccessIDs) > 0 {
+			remainingHmacAccessIDs, hmacDeleteCount, err := iamService.PurgeHmacKeys(currentState.FullServiceAccountName, desiredState.PurgeKeysAfterHours, currentState.IssuedHmacAccessIDs, currentState.HmacAccessID)
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed purging service account %v hmac keys", currentState.FullServiceAccountName)
+				keyPurgeTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+				return err
+			}
+			purgeResult.DeleteCount += hmacDeleteCount
+			currentState.IssuedHmacAccessIDs = remainingHmacAccessIDs
 		}
 
-		decodedPrivateKeyData, err := base64.StdEncoding.DecodeString(serviceAccountKey.PrivateKeyData)
+		// reload secret to avoid object has been modified error
+		secret, err = kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
 		if err != nil {
 			log.Error().Err(err)
-			keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
 			return err
 		}
 
-		// service account keyfile
-		filename := desiredState.Filename
-		if filename == "" {
-			filename = "service-account-key.json"
+		// remove the previous key from the secret once it has been purged
+		if previousKeyfile, ok := secret.Data[filename+".previous"]; ok {
+			previousKey, err := parseServiceAccountKeyfile(previousKeyfile)
+			if err != nil || !foundation.StringArrayContains(purgeResult.ActiveKeyIDs, previousKey.PrivateKeyID) {
+				log.Info().Msgf("[%v] Secret %v.%v - Removing previous key from secret because it has been purged...", initiator, secret.Name, secret.Namespace)
+				delete(secret.Data, filename+".previous")
+			}
+		}
+
+		// store active, issued and unknown key ids in the state
+		currentState.ActiveKeyIDs = purgeResult.ActiveKeyIDs
+		currentState.IssuedKeyIDs = purgeResult.IssuedKeyIDs
+		currentState.UnknownKeyIDs = purgeResult.UnknownKeyIDs
+		currentState.DisabledKeys = purgeResult.DisabledKeys
+		if len(purgeResult.UnknownKeyIDs) > 0 {
+			log.Warn().Msgf("[%v] Secret %v.%v - Service account %v has %v keys not issued by this controller: %v", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName, len(purgeResult.UnknownKeyIDs), strings.Join(purgeResult.UnknownKeyIDs, ", "))
 		}
-		secret.Data[filename] = decodedPrivateKeyData
 
 		err = updateSecret(kubeClientset, secret, *currentState, initiator)
 		if err != nil {
-			keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			keyPurgeTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
 			return err
 		}
 
-		log.Info().Msgf("[%v] Secret %v.%v - Service account keyfile has been renewed successfully...", initiator, secret.Name, secret.Namespace)
-
-		keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+		keyDisableTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Add(float64(purgeResult.DisableCount))
+		keyPurgeTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Add(float64(purgeResult.DeleteCount))
 
 		return nil
 	}
 
-	keyRotationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "skipped", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+	keyPurgeTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "skipped", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
 
 	return nil
 }
 
-func makeSecretChangesPurgeKeys(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, lastAttempt, lastRenewed time.Time) (err error) {
+func makeSecretChangesReenableKeys(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, lastAttempt time.Time) (err error) {
+
+	reenableKeyIDs := []string{}
+	for _, keyID := range getRetainedKeyIDs(desiredState, *currentState) {
+		if _, disabled := currentState.DisabledKeys[keyID]; disabled {
+			reenableKeyIDs = append(reenableKeyIDs, keyID)
+		}
+	}
 
 	if (*mode == "normal" || *mode == "convenient" || *mode == "rotate_keys_only") &&
 		time.Since(lastAttempt).Minutes() > 15 &&
-		currentState.Enabled == "true" &&
-		currentState.LastRenewed != "" &&
-		time.Since(lastRenewed).Hours() > 2 &&
 		currentState.FullServiceAccountName != "" &&
-		(!*allowDisableKeyRotationOverride || !desiredState.DisableKeyRotation) {
+		len(reenableKeyIDs) > 0 {
 
-		log.Info().Msgf("[%v] Secret %v.%v - Checking %v for keys to purge...", initiator, secret.Name, secret.Namespace, currentState.Name)
+		log.Info().Msgf("[%v] Secret %v.%v - Re-enabling %v disabled keys for %v...", initiator, secret.Name, secret.Namespace, len(reenableKeyIDs), currentState.Name)
 
 		// 'lock' the secret for 15 minutes by storing the last attempt timestamp to prevent hitting the rate limit if the Google Cloud IAM api call fails and to prevent the watcher and the fallback polling to operate on the secret at the same time
 		currentState.LastAttempt = time.Now().Format(time.RFC3339)
 
 		err = updateSecret(kubeClientset, secret, *currentState, initiator)
 		if err != nil {
-			keyPurgeTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
 			return err
 		}
 
-		// purge old service account keys
-		deleteCount, err := iamService.PurgeServiceAccountKeys(currentState.FullServiceAccountName, *purgeKeysAfterHours)
+		for _, keyID := range reenableKeyIDs {
+			err = iamService.EnableServiceAccountKey(currentState.FullServiceAccountName, keyID)
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed re-enabling key %v for service account %v", keyID, currentState.FullServiceAccountName)
+				return err
+			}
+			delete(currentState.DisabledKeys, keyID)
+		}
+
+		// reload secret to avoid object has been modified error
+		secret, err = kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
 		if err != nil {
-			log.Error().Err(err).Msgf("Failed purging service account %v keys", currentState.FullServiceAccountName)
-			keyPurgeTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			log.Error().Err(err)
 			return err
 		}
 
-		keyPurgeTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Add(float64(deleteCount))
+		err = updateSecret(kubeClientset, secret, *currentState, initiator)
+		if err != nil {
+			return err
+		}
 
-		return nil
+		log.Info().Msgf("[%v] Secret %v.%v - Keys %v have been re-enabled successfully...", initiator, secret.Name, secret.Namespace, strings.Join(reenableKeyIDs, ", "))
 	}
 
-	keyPurgeTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "skipped", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
-
 	return nil
 }
 
-func processSecret(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string) (err error) {
+// getRetainedKeyIDs returns the ids of keys that should be re-enabled and kept out of purging as long as the re-enable annotation is set
+func getRetainedKeyIDs(desiredState, currentState GCPServiceAccountState) []string {
+	if foundation.StringArrayContains(desiredState.ReenableKeyIDs, "all") {
+		return currentState.IssuedKeyIDs
+	}
+
+	return desiredState.ReenableKeyIDs
+}
+
+func processSecret(kubeClientset *kubernetes.Clientset, iamServices *GoogleCloudIAMServices, secret *v1.Secret, initiator string) (err error) {
 
 	if secret != nil && secret.ObjectMeta.Annotations != nil {
 
-		desiredState := getDesiredSecretState(secret)
-		currentState := getCurrentSecretState(secret)
+		// the namespace is only retrieved for secrets handled by this controller to limit calls to the kubernetes api
+		namespaceAnnotations := map[string]string{}
+		if _, ok := secret.ObjectMeta.Annotations[annotationGCPServiceAccount]; ok {
+			namespaceAnnotations, err = getNamespaceAnnotations(kubeClientset, secret.Namespace)
+			if err != nil {
+				log.Error().Err(err).Msgf("[%v] Secret %v.%v - Not acting on secret, because the defaults and restrictions of its namespace are unknown", initiator, secret.Name, secret.Namespace)
+				return err
+			}
+		}
+
+		var desiredState, currentState GCPServiceAccountState
+		desiredState, err = getDesiredSecretState(secret, namespaceAnnotations)
+		if err != nil {
+			reportInvalidState(kubeClientset, getSecretObjectReference(secret), initiator, "desired", err)
+			return err
+		}
+		currentState, err = getCurrentSecretState(secret)
+		if err != nil {
+			reportInvalidState(kubeClientset, getSecretObjectReference(secret), initiator, "current", err)
+			return err
+		}
+
+		var iamService *GoogleCloudIAMService
+		iamService, err = iamServices.ForState(secret.Namespace, desiredState.ServiceAccountProjectID, currentState.FullServiceAccountName)
+		if err == ErrServiceAccountProjectNotAllowed {
+			reportInvalidState(kubeClientset, getSecretObjectReference(secret), initiator, "current", fmt.Errorf("Service account %v: %v", currentState.FullServiceAccountName, err))
+			return err
+		}
+		if err != nil {
+			log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed creating iam service for the service account project", initiator, secret.Name, secret.Namespace)
+			return err
+		}
 
 		err = makeSecretChanges(kubeClientset, iamService, secret, initiator, desiredState, currentState)
 		if err != nil {
@@ -656,17 +2031,41 @@ func processSecret(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudI
 	return nil
 }
 
-func deleteSecret(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string) (err error) {
+func deleteSecret(kubeClientset *kubernetes.Clientset, iamServices *GoogleCloudIAMServices, secret *v1.Secret, initiator string) (err error) {
 
 	log.Info().Msgf("[%v] Secret %v.%v - Deleting service account because secret has been deleted...", initiator, secret.Name, secret.Namespace)
 
 	if (*mode == "normal" || *mode == "convenient") && secret != nil && secret.ObjectMeta.Annotations != nil {
 
-		currentState := getCurrentSecretState(secret)
+		currentState, err := getCurrentSecretState(secret)
+		if err != nil {
+			log.Error().Err(err).Msgf("[%v] Secret %v.%v - Can't delete service account, because the state is invalid", initiator, secret.Name, secret.Namespace)
+			invalidStateTotals.With(prometheus.Labels{"namespace": secret.Namespace, "initiator": initiator, "type": "secret", "state": "current"}).Inc()
+			return err
+		}
 
 		if currentState.FullServiceAccountName != "" {
+			// the namespace might already be gone, so the service account is deleted in the project it has been created in, as long as that's a configured project or the one set on the namespace
+			annotatedProjectID := ""
+			if namespaceAnnotations, err := getNamespaceAnnotations(kubeClientset, secret.Namespace); err == nil {
+				annotatedProjectID = strings.TrimSpace(namespaceAnnotations[annotationGCPServiceAccountProject])
+			}
+			iamService, err := iamServices.ForServiceAccount(annotatedProjectID, currentState.FullServiceAccountName)
+			if err == ErrServiceAccountProjectNotAllowed {
+				reportInvalidState(kubeClientset, getSecretObjectReference(secret), initiator, "current", fmt.Errorf("Service account %v: %v", currentState.FullServiceAccountName, err))
+				return err
+			}
+			if err != nil {
+				log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed creating iam service for the project of service account %v", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName)
+				return err
+			}
+
 			deleted, err := iamService.DeleteServiceAccount(currentState.FullServiceAccountName)
 
+			if err == ErrServiceAccountNotFound {
+				log.Info().Msgf("[%v] Secret %v.%v - Service account %v has already been deleted...", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName)
+				return nil
+			}
 			if err != nil {
 				log.Error().Err(err).Msgf("Failed deleting service account %v", currentState.Name)
 				serviceAccountDeleteTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": "watcher", "type": "secret"}).Inc()
@@ -684,13 +2083,15 @@ func deleteSecret(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIA
 }
 
 // Kubernetes serviceAccount
-func watchServiceAccounts(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService) {
+func watchServiceAccounts(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset, iamServices *GoogleCloudIAMServices) {
 	// loop indefinitely
 	for {
-		log.Info().Msg("Watching serviceaccounts for all namespaces...")
+		log.Info().Msgf("Watching serviceaccounts for %v...", namespaceFilter.Description())
 		timeoutSeconds := int64(300)
-		watcher, err := kubeClientset.CoreV1().ServiceAccounts("").Watch(context.Background(), metav1.ListOptions{
+		watcher, err := kubeClientset.CoreV1().ServiceAccounts(namespaceFilter.Namespace()).Watch(context.Background(), metav1.ListOptions{
 			TimeoutSeconds: &timeoutSeconds,
+			LabelSelector:  *labelSelector,
+			FieldSelector:  namespaceFilter.FieldSelector(),
 		})
 
 		if err != nil {
@@ -709,8 +2110,11 @@ func watchServiceAccounts(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.C
 						log.Warn().Msg("Watcher for serviceaccount returns event object of incorrect type")
 						break
 					}
+					if !namespaceFilter.IsManaged(serviceAccount.Namespace) {
+						continue
+					}
 					waitGroup.Add(1)
-					processServiceAccount(kubeClientset, iamService, serviceAccount, fmt.Sprintf("watcher:%v", event.Type))
+					processServiceAccount(kubeClientset, iamServices, serviceAccount, fmt.Sprintf("watcher:%v", event.Type))
 					waitGroup.Done()
 				}
 			}
@@ -722,7 +2126,7 @@ func watchServiceAccounts(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.C
 	}
 }
 
-func listServiceAccounts(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService) {
+func listServiceAccounts(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Clientset, iamServices *GoogleCloudIAMServices) {
 	// sleep random time before polling in order to avoid race conditions (look at waitgroups in the future)
 	sleepTime := foundation.ApplyJitter(30)
 	log.Info().Msgf("Sleeping for %v seconds...", sleepTime)
@@ -732,8 +2136,11 @@ func listServiceAccounts(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Cl
 	for {
 
 		// get serviceaccounts for all namespaces
-		log.Info().Msg("Listing serviceaccounts for all namespaces...")
-		serviceAccounts, err := kubeClientset.CoreV1().ServiceAccounts("").List(context.Background(), metav1.ListOptions{})
+		log.Info().Msgf("Listing serviceaccounts for %v...", namespaceFilter.Description())
+		serviceAccounts, err := kubeClientset.CoreV1().ServiceAccounts(namespaceFilter.Namespace()).List(context.Background(), metav1.ListOptions{
+			LabelSelector: *labelSelector,
+			FieldSelector: namespaceFilter.FieldSelector(),
+		})
 		if err != nil {
 			log.Error().Err(err).Msg("listServiceAccounts call failed")
 		}
@@ -741,8 +2148,12 @@ func listServiceAccounts(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Cl
 
 		// loop all serviceaccounts
 		for _, serviceAccount := range serviceAccounts.Items {
+			if !namespaceFilter.IsManaged(serviceAccount.Namespace) {
+				continue
+			}
+
 			waitGroup.Add(1)
-			err := processServiceAccount(kubeClientset, iamService, &serviceAccount, "POLLER")
+			err := processServiceAccount(kubeClientset, iamServices, &serviceAccount, "POLLER")
 			waitGroup.Done()
 
 			if err != nil {
@@ -757,7 +2168,7 @@ func listServiceAccounts(waitGroup *sync.WaitGroup, kubeClientset *kubernetes.Cl
 	}
 }
 
-func getDesiredServiceAccountState(serviceAccount *v1.ServiceAccount) (state GCPServiceAccountState) {
+func getDesiredServiceAccountState(serviceAccount *v1.ServiceAccount, namespaceAnnotations map[string]string) (state GCPServiceAccountState, err error) {
 	var ok bool
 	// get annotations or set default value
 	state.Enabled, ok = serviceAccount.ObjectMeta.Annotations[annotationGCPServiceAccount]
@@ -770,22 +2181,26 @@ func getDesiredServiceAccountState(serviceAccount *v1.ServiceAccount) (state GCP
 		state.Name = ""
 	}
 
+	// the namespace can set the project for all service accounts inside it; they're looked up rather than created, so the name prefix doesn't apply
+	namespacePolicy, err := getNamespacePolicy(namespaceAnnotations)
+	applyNamespacePolicy(&state, namespacePolicy, GCPServiceAccountState{}, false)
+
 	return
 }
 
-func getCurrentServiceAccountState(serviceAccount *v1.ServiceAccount) (state GCPServiceAccountState) {
+func getCurrentServiceAccountState(serviceAccount *v1.ServiceAccount) (state GCPServiceAccountState, err error) {
 
 	// get state stored in annotations if present or set to empty struct
 	gcpServiceAccountStateString, ok := serviceAccount.ObjectMeta.Annotations[annotationGCPServiceAccountState]
 	if !ok {
 		// couldn't find saved state, setting to default struct
 		state = GCPServiceAccountState{}
+		return
 	}
 
-	if err := json.Unmarshal([]byte(gcpServiceAccountStateString), &state); err != nil {
-		// couldn't deserialize, setting to default struct
-		state = GCPServiceAccountState{}
-		return
+	if err = json.Unmarshal([]byte(gcpServiceAccountStateString), &state); err != nil {
+		// couldn't deserialize; report it instead of acting on an empty state
+		return GCPServiceAccountState{}, fmt.Errorf("Annotation %v can't be parsed as json: %v", annotationGCPServiceAccountState, err)
 	}
 
 	// return deserialized state
@@ -817,7 +2232,7 @@ func makeServiceAccountChanges(kubeClientset *kubernetes.Clientset, iamService *
 		}
 
 		// fecth service account by display name
-		fullServiceAccountName, fullServiceAccountEmail, err := iamService.GetServiceAccountByDisplayName(desiredState.Name)
+		fullServiceAccountName, fullServiceAccountEmail, uniqueID, err := iamService.GetServiceAccountByDisplayName(desiredState.Name)
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed retrieving gcp service account %v by display name", desiredState.Name)
 			serviceAccountRetrieveTotals.With(prometheus.Labels{"namespace": serviceAccount.Namespace, "status": "failed", "initiator": initiator, "mode": "annotate kubernetes serviceaccount", "type": "serviceaccount"}).Inc()
@@ -836,6 +2251,7 @@ func makeServiceAccountChanges(kubeClientset *kubernetes.Clientset, iamService *
 		currentState.Name = desiredState.Name
 		currentState.FullServiceAccountName = fullServiceAccountName
 		currentState.FullServiceAccountEmail = fullServiceAccountEmail
+		currentState.UniqueID = uniqueID
 
 		log.Info().Msgf("[%v] ServiceAccount %v.%v - Updating serviceAccount because a new service account has been created...", initiator, serviceAccount.Name, serviceAccount.Namespace)
 
@@ -851,10 +2267,40 @@ func makeServiceAccountChanges(kubeClientset *kubernetes.Clientset, iamService *
 	return nil
 }
 
-func processServiceAccount(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, serviceAccount *v1.ServiceAccount, initiator string) (err error) {
+func processServiceAccount(kubeClientset *kubernetes.Clientset, iamServices *GoogleCloudIAMServices, serviceAccount *v1.ServiceAccount, initiator string) (err error) {
 	if serviceAccount != nil && serviceAccount.ObjectMeta.Annotations != nil {
-		desiredState := getDesiredServiceAccountState(serviceAccount)
-		currentState := getCurrentServiceAccountState(serviceAccount)
+		// the namespace is only retrieved for service accounts handled by this controller to limit calls to the kubernetes api
+		namespaceAnnotations := map[string]string{}
+		if _, ok := serviceAccount.ObjectMeta.Annotations[annotationGCPServiceAccount]; ok {
+			namespaceAnnotations, err = getNamespaceAnnotations(kubeClientset, serviceAccount.Namespace)
+			if err != nil {
+				log.Error().Err(err).Msgf("[%v] ServiceAccount %v.%v - Not acting on service account, because the defaults and restrictions of its namespace are unknown", initiator, serviceAccount.Name, serviceAccount.Namespace)
+				return err
+			}
+		}
+
+		var desiredState, currentState GCPServiceAccountState
+		desiredState, err = getDesiredServiceAccountState(serviceAccount, namespaceAnnotations)
+		if err != nil {
+			reportInvalidState(kubeClientset, getServiceAccountObjectReference(serviceAccount), initiator, "desired", err)
+			return err
+		}
+		currentState, err = getCurrentServiceAccountState(serviceAccount)
+		if err != nil {
+			reportInvalidState(kubeClientset, getServiceAccountObjectReference(serviceAccount), initiator, "current", err)
+			return err
+		}
+
+		var iamService *GoogleCloudIAMService
+		iamService, err = iamServices.ForState(serviceAccount.Namespace, desiredState.ServiceAccountProjectID, currentState.FullServiceAccountName)
+		if err == ErrServiceAccountProjectNotAllowed {
+			reportInvalidState(kubeClientset, getServiceAccountObjectReference(serviceAccount), initiator, "current", fmt.Errorf("Service account %v: %v", currentState.FullServiceAccountName, err))
+			return err
+		}
+		if err != nil {
+			log.Error().Err(err).Msgf("[%v] ServiceAccount %v.%v - Failed creating iam service for the service account project", initiator, serviceAccount.Name, serviceAccount.Namespace)
+			return err
+		}
 
 		err = makeServiceAccountChanges(kubeClientset, iamService, serviceAccount, initiator, desiredState, currentState)
 		if err != nil {
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetDesiredSecretState(t *testing.T) {
+	t.Run("ReturnsStateFromAnnotations", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"estafette.io/gcp-service-account":             "true",
+					"estafette.io/gcp-service-account-name":        "my-application",
+					"estafette.io/gcp-service-account-permissions": `[{"project":"my-project","role":"roles/storage.objectViewer"}]`,
+					"estafette.io/gcp-service-account-hmac-keys":   "true",
+				},
+			},
+		}
+
+		// act
+		state, err := getDesiredSecretState(secret, map[string]string{})
+
+		assert.Nil(t, err)
+		assert.Equal(t, "true", state.Enabled)
+		assert.Equal(t, "my-application", state.Name)
+		assert.Equal(t, "service-account-key.json", state.Filename)
+		assert.Equal(t, 1, len(state.Permissions))
+		assert.True(t, state.HmacKeys)
+	})
+
+	t.Run("ReturnsErrorIfPermissionsAreNotValidJSON", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"estafette.io/gcp-service-account":             "true",
+					"estafette.io/gcp-service-account-name":        "my-application",
+					"estafette.io/gcp-service-account-permissions": `[{"project":"my-project"`,
+				},
+			},
+		}
+
+		// act
+		_, err := getDesiredSecretState(secret, map[string]string{})
+
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "estafette.io/gcp-service-account-permissions")
+	})
+
+	t.Run("ReturnsErrorIfBooleanAnnotationCannotBeParsed", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"estafette.io/gcp-service-account":                      "true",
+					"estafette.io/gcp-service-account-name":                 "my-application",
+					"estafette.io/gcp-service-account-disable-key-rotation": "yes",
+				},
+			},
+		}
+
+		// act
+		_, err := getDesiredSecretState(secret, map[string]string{})
+
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "estafette.io/gcp-service-account-disable-key-rotation")
+	})
+
+	t.Run("ReturnsErrorIfHoursAreNotPositive", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"estafette.io/gcp-service-account":                          "true",
+					"estafette.io/gcp-service-account-name":                     "my-application",
+					"estafette.io/gcp-service-account-key-rotation-after-hours": "0",
+				},
+			},
+		}
+
+		// act
+		_, err := getDesiredSecretState(secret, map[string]string{})
+
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "estafette.io/gcp-service-account-key-rotation-after-hours")
+	})
+
+	t.Run("ReturnsErrorAndControllerWindowsIfMaintenanceWindowsCannotBeParsed", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"estafette.io/gcp-service-account":                     "true",
+					"estafette.io/gcp-service-account-name":                "my-application",
+					"estafette.io/gcp-service-account-maintenance-windows": "Monday 09:00-17:00",
+				},
+			},
+		}
+
+		// act
+		state, err := getDesiredSecretState(secret, map[string]string{})
+
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "estafette.io/gcp-service-account-maintenance-windows")
+		assert.Equal(t, "", state.MaintenanceWindows)
+	})
+
+	t.Run("ReturnsErrorAndControllerWindowsIfMaintenanceWindowsTimezoneIsUnknown", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"estafette.io/gcp-service-account":                              "true",
+					"estafette.io/gcp-service-account-name":                         "my-application",
+					"estafette.io/gcp-service-account-maintenance-windows":          "Mon-Fri 09:00-17:00",
+					"estafette.io/gcp-service-account-maintenance-windows-timezone": "Europe/Atlantis",
+				},
+			},
+		}
+
+		// act
+		state, err := getDesiredSecretState(secret, map[string]string{})
+
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "estafette.io/gcp-service-account-maintenance-windows-timezone")
+		assert.Equal(t, "", state.MaintenanceWindows)
+		assert.Equal(t, "", state.MaintenanceWindowsTimezone)
+	})
+
+	t.Run("ReturnsNamespaceDefaultsMergedWithSecretAnnotations", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"estafette.io/gcp-service-account":      "true",
+					"estafette.io/gcp-service-account-name": "my-application",
+				},
+			},
+		}
+		namespaceAnnotations := map[string]string{
+			"estafette.io/gcp-service-account-filename":    "key.json",
+			"estafette.io/gcp-service-account-name-prefix": "tenant-a-",
+		}
+
+		// act
+		state, err := getDesiredSecretState(secret, namespaceAnnotations)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "key.json", state.Filename)
+		assert.Equal(t, "tenant-a-my-application", state.Name)
+	})
+
+	t.Run("ReturnsSecretFilenameOverNamespaceDefault", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"estafette.io/gcp-service-account":          "true",
+					"estafette.io/gcp-service-account-name":     "my-application",
+					"estafette.io/gcp-service-account-filename": "credentials.json",
+				},
+			},
+		}
+
+		// act
+		state, err := getDesiredSecretState(secret, map[string]string{"estafette.io/gcp-service-account-filename": "key.json"})
+
+		assert.Nil(t, err)
+		assert.Equal(t, "credentials.json", state.Filename)
+	})
+
+	t.Run("ReturnsErrorIfNamespaceAnnotationCannotBeParsed", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"estafette.io/gcp-service-account":      "true",
+					"estafette.io/gcp-service-account-name": "my-application",
+				},
+			},
+		}
+
+		// act
+		_, err := getDesiredSecretState(secret, map[string]string{"estafette.io/gcp-service-account-workload-identity-only": "yes"})
+
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "estafette.io/gcp-service-account-workload-identity-only")
+	})
+}
+
+func TestGetCurrentSecretState(t *testing.T) {
+	t.Run("ReturnsEmptyStateIfAnnotationIsMissing", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{},
+			},
+		}
+
+		// act
+		state, err := getCurrentSecretState(secret)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "", state.FullServiceAccountName)
+	})
+
+	t.Run("ReturnsStateFromAnnotation", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"estafette.io/gcp-service-account-state": `{"enabled":"true","name":"my-application","fullServiceAccountName":"projects/my-project/serviceAccounts/my-application-abcd@my-project.iam.gserviceaccount.com"}`,
+				},
+			},
+		}
+
+		// act
+		state, err := getCurrentSecretState(secret)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "projects/my-project/serviceAccounts/my-application-abcd@my-project.iam.gserviceaccount.com", state.FullServiceAccountName)
+	})
+
+	t.Run("ReturnsErrorIfStateIsCorrupt", func(t *testing.T) {
+
+		secret := &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					"estafette.io/gcp-service-account-state": `{"enabled":"true","name":"my-appl`,
+				},
+			},
+		}
+
+		// act
+		_, err := getCurrentSecretState(secret)
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestSecretOutputsChanged(t *testing.T) {
+	t.Run("ReturnsFalseIfOutputsAreUnchanged", func(t *testing.T) {
+
+		desiredState := GCPServiceAccountState{DockerRegistries: []string{"eu.gcr.io"}}
+		currentState := GCPServiceAccountState{DockerRegistries: []string{"eu.gcr.io"}}
+
+		// act
+		changed := secretOutputsChanged(desiredState, currentState)
+
+		assert.False(t, changed)
+	})
+
+	t.Run("ReturnsTrueIfDerivedFieldsHaveBeenTurnedOff", func(t *testing.T) {
+
+		desiredState := GCPServiceAccountState{DerivedFields: false}
+		currentState := GCPServiceAccountState{DerivedFields: true}
+
+		// act
+		changed := secretOutputsChanged(desiredState, currentState)
+
+		assert.True(t, changed)
+	})
+
+	t.Run("ReturnsTrueIfDockerRegistriesHaveBeenAdded", func(t *testing.T) {
+
+		desiredState := GCPServiceAccountState{DockerRegistries: []string{"europe-docker.pkg.dev", "eu.gcr.io"}}
+		currentState := GCPServiceAccountState{DockerRegistries: []string{"eu.gcr.io"}}
+
+		// act
+		changed := secretOutputsChanged(desiredState, currentState)
+
+		assert.True(t, changed)
+	})
+}
+
+func TestIsDeferralReportDue(t *testing.T) {
+	t.Run("ReturnsTrueOnlyOnceWithin15Minutes", func(t *testing.T) {
+
+		now := time.Date(2020, 11, 23, 20, 0, 0, 0, time.UTC)
+
+		// act
+		due := isDeferralReportDue("rotation/deferral-reported/my-secret", now)
+
+		assert.True(t, due)
+		assert.False(t, isDeferralReportDue("rotation/deferral-reported/my-secret", now.Add(14*time.Minute)))
+		assert.True(t, isDeferralReportDue("purge/deferral-reported/my-secret", now.Add(14*time.Minute)))
+		assert.True(t, isDeferralReportDue("rotation/deferral-reported/my-secret", now.Add(15*time.Minute)))
+	})
+}
+
+func TestIsKeyVerificationDue(t *testing.T) {
+	t.Run("ReturnsTrueUntilVerificationIsRecorded", func(t *testing.T) {
+
+		secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "verification-not-recorded"}}
+
+		// act
+		due := isKeyVerificationDue(secret)
+
+		assert.True(t, due)
+		assert.True(t, isKeyVerificationDue(secret))
+	})
+
+	t.Run("ReturnsFalseAfterVerificationIsRecorded", func(t *testing.T) {
+
+		defaultKeyVerificationIntervalMinutes := *keyVerificationIntervalMinutes
+		defer func() { *keyVerificationIntervalMinutes = defaultKeyVerificationIntervalMinutes }()
+		*keyVerificationIntervalMinutes = 60
+		secret := &v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Namespace: "verification-recorded"}}
+		recordKeyVerification(secret)
+
+		// act
+		due := isKeyVerificationDue(secret)
+
+		assert.False(t, due)
+	})
+}
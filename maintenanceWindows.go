@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// embed the timezone database, since the container image doesn't have one
+	_ "time/tzdata"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MaintenanceWindow represents a weekly recurring window in which scheduled key rotations and purges are allowed
+type MaintenanceWindow struct {
+	Days         [7]bool
+	StartMinutes int
+	EndMinutes   int
+}
+
+var weekdayAbbreviations = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseMaintenanceWindows parses a semicolon-separated list of windows in the form '<days> <HH:MM>-<HH:MM>', for example 'Mon-Fri 09:00-17:00; Sat 10:00-12:00'; days can be a range, a comma-separated list or '*' for every day, and a window ending before it starts runs past midnight
+func parseMaintenanceWindows(value string) (windows []MaintenanceWindow, err error) {
+
+	for _, windowString := range strings.Split(value, ";") {
+		windowString = strings.TrimSpace(windowString)
+		if windowString == "" {
+			continue
+		}
+
+		fields := strings.Fields(windowString)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Maintenance window '%v' is not in the form '<days> <HH:MM>-<HH:MM>'", windowString)
+		}
+
+		var window MaintenanceWindow
+		window.Days, err = parseMaintenanceWindowDays(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Maintenance window '%v' has invalid days: %v", windowString, err)
+		}
+
+		times := strings.Split(fields[1], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("Maintenance window '%v' has no time range in the form '<HH:MM>-<HH:MM>'", windowString)
+		}
+		window.StartMinutes, err = parseMaintenanceWindowTime(times[0])
+		if err != nil {
+			return nil, fmt.Errorf("Maintenance window '%v' has an invalid start time: %v", windowString, err)
+		}
+		window.EndMinutes, err = parseMaintenanceWindowTime(times[1])
+		if err != nil {
+			return nil, fmt.Errorf("Maintenance window '%v' has an invalid end time: %v", windowString, err)
+		}
+		if window.StartMinutes == window.EndMinutes {
+			return nil, fmt.Errorf("Maintenance window '%v' has the same start and end time", windowString)
+		}
+
+		windows = append(windows, window)
+	}
+
+	return
+}
+
+func parseMaintenanceWindowDays(value string) (days [7]bool, err error) {
+
+	if value == "*" {
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	}
+
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return days, fmt.Errorf("Day range '%v' is invalid", part)
+		}
+
+		first, ok := weekdayAbbreviations[strings.ToLower(bounds[0])]
+		if !ok {
+			return days, fmt.Errorf("Day '%v' is not one of Mon, Tue, Wed, Thu, Fri, Sat or Sun", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, ok = weekdayAbbreviations[strings.ToLower(bounds[1])]
+			if !ok {
+				return days, fmt.Errorf("Day '%v' is not one of Mon, Tue, Wed, Thu, Fri, Sat or Sun", bounds[1])
+			}
+		}
+
+		// ranges can wrap around the end of the week, for example Sat-Mon
+		for day := first; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	return
+}
+
+func parseMaintenanceWindowTime(value string) (minutes int, err error) {
+
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Time '%v' is not in the form HH:MM", value)
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("Time '%v' has invalid hours", value)
+	}
+	mins, err := strconv.Atoi(parts[1])
+	if err != nil || mins < 0 || mins > 59 || (hours == 24 && mins != 0) {
+		return 0, fmt.Errorf("Time '%v' has invalid minutes", value)
+	}
+
+	return hours*60 + mins, nil
+}
+
+// isInMaintenanceWindow returns true if there are no windows or the time falls in one of them; the time should be in the timezone of the windows
+func isInMaintenanceWindow(windows []MaintenanceWindow, t time.Time) bool {
+
+	if len(windows) == 0 {
+		return true
+	}
+
+	minutes := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	previousDay := (day + 6) % 7
+
+	for _, window := range windows {
+		if window.StartMinutes < window.EndMinutes {
+			if window.Days[day] && minutes >= window.StartMinutes && minutes < window.EndMinutes {
+				return true
+			}
+		} else {
+			// the window runs past midnight and belongs to the day it starts on
+			if (window.Days[day] && minutes >= window.StartMinutes) || (window.Days[previousDay] && minutes < window.EndMinutes) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// getNextMaintenanceWindowStart returns the time itself if it falls in one of the windows, or else the start of the next window
+func getNextMaintenanceWindowStart(windows []MaintenanceWindow, t time.Time) time.Time {
+
+	if isInMaintenanceWindow(windows, t) {
+		return t
+	}
+
+	next := time.Time{}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for i := 0; i <= 7; i++ {
+		date := midnight.AddDate(0, 0, i)
+		for _, window := range windows {
+			if !window.Days[date.Weekday()] {
+				continue
+			}
+			start := time.Date(date.Year(), date.Month(), date.Day(), window.StartMinutes/60, window.StartMinutes%60, 0, 0, t.Location())
+			if start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+	}
+
+	return next
+}
+
+// getMaintenanceWindowStatus returns whether scheduled rotations and purges are currently allowed for the secret and if not when they are next allowed; windows set on the secret take precedence over the controller's windows
+func getMaintenanceWindowStatus(desiredState GCPServiceAccountState, now time.Time) (open bool, next time.Time) {
+
+	windowsString := *maintenanceWindows
+	timezone := *maintenanceWindowsTimezone
+	if desiredState.MaintenanceWindows != "" {
+		windowsString = desiredState.MaintenanceWindows
+		if desiredState.MaintenanceWindowsTimezone != "" {
+			timezone = desiredState.MaintenanceWindowsTimezone
+		}
+	}
+
+	windows, err := parseMaintenanceWindows(windowsString)
+	if err == nil {
+		location, locationErr := time.LoadLocation(timezone)
+		if locationErr == nil {
+			now = now.In(location)
+		}
+		err = locationErr
+	}
+	if err != nil {
+		// fall back to the controller's windows, which are validated at startup
+		log.Warn().Err(err).Msgf("Maintenance windows '%v' in timezone %v are invalid, using the controller's maintenance windows", windowsString, timezone)
+		windows, _ = parseMaintenanceWindows(*maintenanceWindows)
+		location, _ := time.LoadLocation(*maintenanceWindowsTimezone)
+		now = now.In(location)
+	}
+
+	next = getNextMaintenanceWindowStart(windows, now)
+
+	return next.Equal(now), next
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMaintenanceWindows(t *testing.T) {
+	t.Run("ReturnsWindowForDayRangeAndTimeRange", func(t *testing.T) {
+
+		// act
+		windows, err := parseMaintenanceWindows("Mon-Fri 09:00-17:30")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(windows))
+		assert.Equal(t, [7]bool{false, true, true, true, true, true, false}, windows[0].Days)
+		assert.Equal(t, 540, windows[0].StartMinutes)
+		assert.Equal(t, 1050, windows[0].EndMinutes)
+	})
+
+	t.Run("ReturnsWindowForEachSemicolonSeparatedWindow", func(t *testing.T) {
+
+		// act
+		windows, err := parseMaintenanceWindows("Sat,Sun 10:00-12:00; * 22:00-02:00")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(windows))
+		assert.Equal(t, [7]bool{true, false, false, false, false, false, true}, windows[0].Days)
+		assert.Equal(t, [7]bool{true, true, true, true, true, true, true}, windows[1].Days)
+	})
+
+	t.Run("ReturnsWindowForDayRangeWrappingAroundTheWeek", func(t *testing.T) {
+
+		// act
+		windows, err := parseMaintenanceWindows("Sat-Mon 00:00-24:00")
+
+		assert.Nil(t, err)
+		assert.Equal(t, [7]bool{true, true, false, false, false, false, true}, windows[0].Days)
+		assert.Equal(t, 1440, windows[0].EndMinutes)
+	})
+
+	t.Run("ReturnsNoWindowsForEmptyValue", func(t *testing.T) {
+
+		// act
+		windows, err := parseMaintenanceWindows("")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(windows))
+	})
+
+	t.Run("ReturnsErrorForUnknownDay", func(t *testing.T) {
+
+		// act
+		_, err := parseMaintenanceWindows("Monday 09:00-17:00")
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForInvalidTime", func(t *testing.T) {
+
+		// act
+		_, err := parseMaintenanceWindows("Mon 09:00-25:00")
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorForMissingTimeRange", func(t *testing.T) {
+
+		// act
+		_, err := parseMaintenanceWindows("Mon-Fri")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestIsInMaintenanceWindow(t *testing.T) {
+	t.Run("ReturnsTrueIfThereAreNoWindows", func(t *testing.T) {
+
+		// act
+		inWindow := isInMaintenanceWindow([]MaintenanceWindow{}, time.Date(2020, 11, 21, 3, 0, 0, 0, time.UTC))
+
+		assert.True(t, inWindow)
+	})
+
+	t.Run("ReturnsTrueIfTimeIsWithinWindow", func(t *testing.T) {
+
+		windows, _ := parseMaintenanceWindows("Mon-Fri 09:00-17:00")
+
+		// act
+		inWindow := isInMaintenanceWindow(windows, time.Date(2020, 11, 23, 9, 0, 0, 0, time.UTC))
+
+		assert.True(t, inWindow)
+	})
+
+	t.Run("ReturnsFalseIfTimeIsAtEndOfWindow", func(t *testing.T) {
+
+		windows, _ := parseMaintenanceWindows("Mon-Fri 09:00-17:00")
+
+		// act
+		inWindow := isInMaintenanceWindow(windows, time.Date(2020, 11, 23, 17, 0, 0, 0, time.UTC))
+
+		assert.False(t, inWindow)
+	})
+
+	t.Run("ReturnsFalseIfDayIsNotInWindow", func(t *testing.T) {
+
+		windows, _ := parseMaintenanceWindows("Mon-Fri 09:00-17:00")
+
+		// act
+		inWindow := isInMaintenanceWindow(windows, time.Date(2020, 11, 21, 12, 0, 0, 0, time.UTC))
+
+		assert.False(t, inWindow)
+	})
+
+	t.Run("ReturnsTrueAfterMidnightForWindowStartingTheDayBefore", func(t *testing.T) {
+
+		windows, _ := parseMaintenanceWindows("Fri 22:00-02:00")
+
+		// act
+		inWindow := isInMaintenanceWindow(windows, time.Date(2020, 11, 21, 1, 0, 0, 0, time.UTC))
+
+		assert.True(t, inWindow)
+	})
+}
+
+func TestGetNextMaintenanceWindowStart(t *testing.T) {
+	t.Run("ReturnsTimeItselfIfWithinWindow", func(t *testing.T) {
+
+		windows, _ := parseMaintenanceWindows("Mon-Fri 09:00-17:00")
+		now := time.Date(2020, 11, 23, 10, 0, 0, 0, time.UTC)
+
+		// act
+		next := getNextMaintenanceWindowStart(windows, now)
+
+		assert.Equal(t, now, next)
+	})
+
+	t.Run("ReturnsStartOfWindowLaterTheSameDay", func(t *testing.T) {
+
+		windows, _ := parseMaintenanceWindows("Mon-Fri 09:00-17:00")
+
+		// act
+		next := getNextMaintenanceWindowStart(windows, time.Date(2020, 11, 23, 7, 0, 0, 0, time.UTC))
+
+		assert.Equal(t, time.Date(2020, 11, 23, 9, 0, 0, 0, time.UTC), next)
+	})
+
+	t.Run("ReturnsStartOfWindowAfterTheWeekend", func(t *testing.T) {
+
+		windows, _ := parseMaintenanceWindows("Mon-Fri 09:00-17:00")
+
+		// act
+		next := getNextMaintenanceWindowStart(windows, time.Date(2020, 11, 20, 18, 0, 0, 0, time.UTC))
+
+		assert.Equal(t, time.Date(2020, 11, 23, 9, 0, 0, 0, time.UTC), next)
+	})
+
+	t.Run("ReturnsStartOfWindowInItsTimezone", func(t *testing.T) {
+
+		location, err := time.LoadLocation("Europe/Amsterdam")
+		assert.Nil(t, err)
+		windows, _ := parseMaintenanceWindows("Mon-Fri 09:00-17:00")
+
+		// act
+		next := getNextMaintenanceWindowStart(windows, time.Date(2020, 11, 23, 7, 30, 0, 0, time.UTC).In(location))
+
+		assert.Equal(t, time.Date(2020, 11, 23, 8, 0, 0, 0, time.UTC).Unix(), next.Unix())
+	})
+}
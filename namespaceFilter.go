@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	foundation "github.com/estafette/estafette-foundation"
+	"github.com/rs/zerolog/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// NamespaceFilter decides which namespaces the controller manages secrets and service accounts in
+type NamespaceFilter struct {
+	include  []string
+	exclude  []string
+	selector string
+
+	// the namespaces matching the label selector are listed at most every 5 minutes
+	listNamespaces             func(selector string) (map[string]bool, error)
+	selectedNamespaces         map[string]bool
+	selectedNamespacesListedAt time.Time
+	mutex                      sync.Mutex
+}
+
+// NewNamespaceFilter returns a filter for comma-separated lists of namespaces to include and exclude and a namespace label selector; empty values don't filter
+func NewNamespaceFilter(kubeClientset *kubernetes.Clientset, include, exclude, selector string) (filter *NamespaceFilter, err error) {
+
+	if selector != "" {
+		_, err = labels.Parse(selector)
+		if err != nil {
+			return
+		}
+	}
+
+	return &NamespaceFilter{
+		include:  splitCommaSeparatedList(include),
+		exclude:  splitCommaSeparatedList(exclude),
+		selector: selector,
+		listNamespaces: func(selector string) (map[string]bool, error) {
+			namespaces, err := kubeClientset.CoreV1().Namespaces().List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+			if err != nil {
+				return nil, err
+			}
+			selectedNamespaces := map[string]bool{}
+			for _, namespace := range namespaces.Items {
+				selectedNamespaces[namespace.Name] = true
+			}
+			return selectedNamespaces, nil
+		},
+	}, nil
+}
+
+// IsManaged returns true if objects in the namespace are managed by this controller
+func (filter *NamespaceFilter) IsManaged(namespace string) bool {
+
+	if filter == nil {
+		return true
+	}
+	if len(filter.include) > 0 && !foundation.StringArrayContains(filter.include, namespace) {
+		return false
+	}
+	if foundation.StringArrayContains(filter.exclude, namespace) {
+		return false
+	}
+	if filter.selector == "" {
+		return true
+	}
+
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+
+	if filter.selectedNamespaces == nil || time.Since(filter.selectedNamespacesListedAt) > 5*time.Minute {
+		selectedNamespaces, err := filter.listNamespaces(filter.selector)
+		if err != nil {
+			// keep using the previously selected namespaces; without them nothing is managed until listing succeeds
+			log.Error().Err(err).Msgf("Failed listing namespaces with label selector %v", filter.selector)
+		} else {
+			filter.selectedNamespaces = selectedNamespaces
+			filter.selectedNamespacesListedAt = time.Now()
+		}
+	}
+
+	return filter.selectedNamespaces[namespace]
+}
+
+// Namespace returns the namespace to list and watch objects in; this is only a single namespace if exactly one namespace is included, otherwise it's all namespaces
+func (filter *NamespaceFilter) Namespace() string {
+
+	if filter != nil && len(filter.include) == 1 {
+		return filter.include[0]
+	}
+
+	return ""
+}
+
+// FieldSelector returns a field selector excluding the excluded namespaces server-side
+func (filter *NamespaceFilter) FieldSelector() string {
+
+	if filter == nil {
+		return ""
+	}
+
+	fieldSelectors := []string{}
+	for _, namespace := range filter.exclude {
+		fieldSelectors = append(fieldSelectors, "metadata.namespace!="+namespace)
+	}
+
+	return strings.Join(fieldSelectors, ",")
+}
+
+// Description returns a description of the namespaces this controller manages for logging
+func (filter *NamespaceFilter) Description() string {
+
+	if filter == nil || (len(filter.include) == 0 && len(filter.exclude) == 0 && filter.selector == "") {
+		return "all namespaces"
+	}
+
+	descriptions := []string{}
+	if len(filter.include) > 0 {
+		descriptions = append(descriptions, "namespaces "+strings.Join(filter.include, ", "))
+	} else {
+		descriptions = append(descriptions, "all namespaces")
+	}
+	if len(filter.exclude) > 0 {
+		descriptions = append(descriptions, "except "+strings.Join(filter.exclude, ", "))
+	}
+	if filter.selector != "" {
+		descriptions = append(descriptions, "with labels "+filter.selector)
+	}
+
+	return strings.Join(descriptions, " ")
+}
+
+// splitCommaSeparatedList splits a comma-separated list and drops empty items
+func splitCommaSeparatedList(value string) (items []string) {
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaceFilter(t *testing.T) {
+	t.Run("ReturnsTrueForAnyNamespaceIfFilterIsEmpty", func(t *testing.T) {
+
+		filter, err := NewNamespaceFilter(nil, "", "", "")
+		assert.Nil(t, err)
+
+		// act
+		managed := filter.IsManaged("kube-system")
+
+		assert.True(t, managed)
+	})
+
+	t.Run("ReturnsFalseForNamespaceNotIncluded", func(t *testing.T) {
+
+		filter, _ := NewNamespaceFilter(nil, "tenant-a, tenant-b", "", "")
+
+		// act
+		managed := filter.IsManaged("tenant-c")
+
+		assert.False(t, managed)
+		assert.True(t, filter.IsManaged("tenant-b"))
+	})
+
+	t.Run("ReturnsFalseForExcludedNamespace", func(t *testing.T) {
+
+		filter, _ := NewNamespaceFilter(nil, "", "kube-system", "")
+
+		// act
+		managed := filter.IsManaged("kube-system")
+
+		assert.False(t, managed)
+		assert.True(t, filter.IsManaged("default"))
+	})
+
+	t.Run("ReturnsTrueOnlyForNamespacesMatchingLabelSelector", func(t *testing.T) {
+
+		filter, _ := NewNamespaceFilter(nil, "", "", "tenant=true")
+		filter.listNamespaces = func(selector string) (map[string]bool, error) {
+			return map[string]bool{"tenant-a": true}, nil
+		}
+
+		// act
+		managed := filter.IsManaged("tenant-a")
+
+		assert.True(t, managed)
+		assert.False(t, filter.IsManaged("default"))
+	})
+
+	t.Run("ReturnsFalseIfNamespacesMatchingLabelSelectorCannotBeListed", func(t *testing.T) {
+
+		filter, _ := NewNamespaceFilter(nil, "", "", "tenant=true")
+		filter.listNamespaces = func(selector string) (map[string]bool, error) {
+			return nil, fmt.Errorf("forbidden")
+		}
+
+		// act
+		managed := filter.IsManaged("tenant-a")
+
+		assert.False(t, managed)
+	})
+
+	t.Run("ReturnsErrorForInvalidLabelSelector", func(t *testing.T) {
+
+		// act
+		_, err := NewNamespaceFilter(nil, "", "", "tenant in (")
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsSingleIncludedNamespaceToListIn", func(t *testing.T) {
+
+		filter, _ := NewNamespaceFilter(nil, "tenant-a", "", "")
+
+		// act
+		namespace := filter.Namespace()
+
+		assert.Equal(t, "tenant-a", namespace)
+	})
+
+	t.Run("ReturnsAllNamespacesToListInIfMultipleAreIncluded", func(t *testing.T) {
+
+		filter, _ := NewNamespaceFilter(nil, "tenant-a,tenant-b", "", "")
+
+		// act
+		namespace := filter.Namespace()
+
+		assert.Equal(t, "", namespace)
+	})
+
+	t.Run("ReturnsFieldSelectorExcludingNamespaces", func(t *testing.T) {
+
+		filter, _ := NewNamespaceFilter(nil, "", "kube-system,kube-public", "")
+
+		// act
+		fieldSelector := filter.FieldSelector()
+
+		assert.Equal(t, "metadata.namespace!=kube-system,metadata.namespace!=kube-public", fieldSelector)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	foundation "github.com/estafette/estafette-foundation"
+)
+
+// annotations on a namespace that only apply to namespaces; besides these a namespace can set the filename, key rotation and purge interval annotations as defaults for the secrets inside it
+const (
+	annotationGCPServiceAccountProject              string = "estafette.io/gcp-service-account-project"
+	annotationGCPServiceAccountAllowedRoles         string = "estafette.io/gcp-service-account-allowed-roles"
+	annotationGCPServiceAccountNamePrefix           string = "estafette.io/gcp-service-account-name-prefix"
+	annotationGCPServiceAccountKeysDisabled         string = "estafette.io/gcp-service-account-keys-disabled"
+	annotationGCPServiceAccountWorkloadIdentityOnly string = "estafette.io/gcp-service-account-workload-identity-only"
+)
+
+// NamespacePolicy represents the defaults and restrictions a namespace sets for the secrets and service accounts inside it
+type NamespacePolicy struct {
+	Filename                string
+	ServiceAccountProjectID string
+	AllowedRoles            []string
+	NamePrefix              string
+	KeysDisabled            bool
+	WorkloadIdentityOnly    bool
+}
+
+// getNamespacePolicy reads the defaults and restrictions from the annotations of a namespace
+func getNamespacePolicy(namespaceAnnotations map[string]string) (policy NamespacePolicy, err error) {
+
+	parseErrors := []string{}
+
+	policy.Filename = namespaceAnnotations[annotationGCPServiceAccountFilename]
+	policy.ServiceAccountProjectID = strings.TrimSpace(namespaceAnnotations[annotationGCPServiceAccountProject])
+	policy.NamePrefix = namespaceAnnotations[annotationGCPServiceAccountNamePrefix]
+
+	if allowedRolesString, ok := namespaceAnnotations[annotationGCPServiceAccountAllowedRoles]; ok {
+		// an empty list is kept as an empty slice, which allows no roles at all, unlike a missing annotation
+		policy.AllowedRoles = splitCommaSeparatedList(allowedRolesString)
+		if policy.AllowedRoles == nil {
+			policy.AllowedRoles = []string{}
+		}
+	}
+
+	// the interval defaults are applied by getEffectiveHours, but checked here so a namespace with an invalid value isn't silently ignored
+	for _, annotation := range []string{annotationGCPServiceAccountKeyRotationAfterHours, annotationGCPServiceAccountPurgeKeysAfterHours} {
+		if hoursValue, ok := namespaceAnnotations[annotation]; ok {
+			if hours, err := strconv.Atoi(hoursValue); err != nil || hours <= 0 {
+				parseErrors = append(parseErrors, fmt.Sprintf("Namespace annotation %v has value '%v', which isn't a positive number of hours", annotation, hoursValue))
+			}
+		}
+	}
+
+	if keysDisabledValue, ok := namespaceAnnotations[annotationGCPServiceAccountKeysDisabled]; ok {
+		policy.KeysDisabled, err = strconv.ParseBool(keysDisabledValue)
+		if err != nil {
+			// fail closed, a namespace that tries to disable keys shouldn't get them because of a typo
+			policy.KeysDisabled = true
+			parseErrors = append(parseErrors, fmt.Sprintf("Namespace annotation %v has value '%v', which can't be parsed: %v", annotationGCPServiceAccountKeysDisabled, keysDisabledValue, err))
+		}
+	}
+
+	if workloadIdentityOnlyValue, ok := namespaceAnnotations[annotationGCPServiceAccountWorkloadIdentityOnly]; ok {
+		policy.WorkloadIdentityOnly, err = strconv.ParseBool(workloadIdentityOnlyValue)
+		if err != nil {
+			policy.WorkloadIdentityOnly = true
+			parseErrors = append(parseErrors, fmt.Sprintf("Namespace annotation %v has value '%v', which can't be parsed: %v", annotationGCPServiceAccountWorkloadIdentityOnly, workloadIdentityOnlyValue, err))
+		}
+	}
+
+	if len(parseErrors) > 0 {
+		return policy, fmt.Errorf("%v", strings.Join(parseErrors, "; "))
+	}
+
+	return policy, nil
+}
+
+// applyNamespacePolicy sets the namespace defaults on a desired state and enforces its restrictions, recording what had to be changed as policy violations; the name prefix only applies to service accounts this controller is about to create, since existing and pre-created accounts are found by their unprefixed name
+func applyNamespacePolicy(desiredState *GCPServiceAccountState, policy NamespacePolicy, currentState GCPServiceAccountState, createsServiceAccount bool) {
+
+	desiredState.ServiceAccountProjectID = policy.ServiceAccountProjectID
+	desiredState.KeysDisabled = policy.KeysDisabled
+	desiredState.WorkloadIdentityOnly = policy.WorkloadIdentityOnly
+
+	if policy.NamePrefix != "" && desiredState.Name != "" && !strings.HasPrefix(desiredState.Name, policy.NamePrefix) && createsServiceAccount && currentState.FullServiceAccountName == "" {
+		prefixedName := policy.NamePrefix + desiredState.Name
+		if len(prefixedName) < 5 || len(prefixedName) > 69 || !serviceAccountNameRegex.MatchString(prefixedName) {
+			// don't create an account with a name the iam api rejects or that is derived differently than the name the user expects
+			desiredState.PolicyViolations = append(desiredState.PolicyViolations, fmt.Sprintf("Name %v with namespace prefix %v isn't a valid service account name of 5 to 69 lowercase letters, digits and '-' starting with a letter; no service account is created", desiredState.Name, policy.NamePrefix))
+			desiredState.Name = ""
+		} else {
+			desiredState.Name = prefixedName
+		}
+	}
+
+	if policy.AllowedRoles != nil {
+		allowedPermissions := []GCPServiceAccountPermission{}
+		for _, permission := range desiredState.Permissions {
+			if !foundation.StringArrayContains(policy.AllowedRoles, permission.Role) {
+				desiredState.PolicyViolations = append(desiredState.PolicyViolations, fmt.Sprintf("Role %v on project %v isn't allowed in this namespace", permission.Role, permission.Project))
+				continue
+			}
+			allowedPermissions = append(allowedPermissions, permission)
+		}
+		desiredState.Permissions = allowedPermissions
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetNamespacePolicy(t *testing.T) {
+	t.Run("ReturnsEmptyPolicyIfNamespaceHasNoAnnotations", func(t *testing.T) {
+
+		// act
+		policy, err := getNamespacePolicy(map[string]string{})
+
+		assert.Nil(t, err)
+		assert.Equal(t, "", policy.Filename)
+		assert.Nil(t, policy.AllowedRoles)
+		assert.False(t, policy.KeysDisabled)
+		assert.False(t, policy.WorkloadIdentityOnly)
+	})
+
+	t.Run("ReturnsPolicyFromAnnotations", func(t *testing.T) {
+
+		// act
+		policy, err := getNamespacePolicy(map[string]string{
+			"estafette.io/gcp-service-account-filename":               "key.json",
+			"estafette.io/gcp-service-account-project":                "tenant-a-accounts",
+			"estafette.io/gcp-service-account-allowed-roles":          "roles/storage.objectViewer, roles/pubsub.subscriber",
+			"estafette.io/gcp-service-account-name-prefix":            "tenant-a-",
+			"estafette.io/gcp-service-account-keys-disabled":          "true",
+			"estafette.io/gcp-service-account-workload-identity-only": "false",
+		})
+
+		assert.Nil(t, err)
+		assert.Equal(t, "key.json", policy.Filename)
+		assert.Equal(t, "tenant-a-accounts", policy.ServiceAccountProjectID)
+		assert.Equal(t, []string{"roles/storage.objectViewer", "roles/pubsub.subscriber"}, policy.AllowedRoles)
+		assert.Equal(t, "tenant-a-", policy.NamePrefix)
+		assert.True(t, policy.KeysDisabled)
+		assert.False(t, policy.WorkloadIdentityOnly)
+	})
+
+	t.Run("ReturnsNoAllowedRolesIfAnnotationIsEmpty", func(t *testing.T) {
+
+		// act
+		policy, err := getNamespacePolicy(map[string]string{
+			"estafette.io/gcp-service-account-allowed-roles": "",
+		})
+
+		assert.Nil(t, err)
+		assert.NotNil(t, policy.AllowedRoles)
+		assert.Equal(t, 0, len(policy.AllowedRoles))
+	})
+
+	t.Run("ReturnsErrorIfIntervalAnnotationIsNotAPositiveNumber", func(t *testing.T) {
+
+		// act
+		_, err := getNamespacePolicy(map[string]string{
+			"estafette.io/gcp-service-account-key-rotation-after-hours": "1w",
+		})
+
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "estafette.io/gcp-service-account-key-rotation-after-hours")
+	})
+
+	t.Run("ReturnsErrorAndRestrictsIfBooleanAnnotationCannotBeParsed", func(t *testing.T) {
+
+		// act
+		policy, err := getNamespacePolicy(map[string]string{
+			"estafette.io/gcp-service-account-keys-disabled": "yes",
+		})
+
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "estafette.io/gcp-service-account-keys-disabled")
+		assert.True(t, policy.KeysDisabled)
+	})
+}
+
+func TestApplyNamespacePolicy(t *testing.T) {
+	t.Run("PrefixesNameIfNotAlreadyPrefixed", func(t *testing.T) {
+
+		state := GCPServiceAccountState{Name: "my-application"}
+
+		// act
+		applyNamespacePolicy(&state, NamespacePolicy{NamePrefix: "tenant-a-"}, GCPServiceAccountState{}, true)
+
+		assert.Equal(t, "tenant-a-my-application", state.Name)
+
+		applyNamespacePolicy(&state, NamespacePolicy{NamePrefix: "tenant-a-"}, GCPServiceAccountState{}, true)
+		assert.Equal(t, "tenant-a-my-application", state.Name)
+	})
+
+	t.Run("DoesNotPrefixNameOfExistingServiceAccount", func(t *testing.T) {
+
+		state := GCPServiceAccountState{Name: "my-application"}
+
+		// act
+		applyNamespacePolicy(&state, NamespacePolicy{NamePrefix: "tenant-a-"}, GCPServiceAccountState{FullServiceAccountName: "projects/my-project/serviceAccounts/my-application-abcd@my-project.iam.gserviceaccount.com"}, true)
+
+		assert.Equal(t, "my-application", state.Name)
+	})
+
+	t.Run("DoesNotPrefixNameOfServiceAccountThatIsLookedUp", func(t *testing.T) {
+
+		state := GCPServiceAccountState{Name: "my-application"}
+
+		// act
+		applyNamespacePolicy(&state, NamespacePolicy{NamePrefix: "tenant-a-"}, GCPServiceAccountState{}, false)
+
+		assert.Equal(t, "my-application", state.Name)
+	})
+
+	t.Run("ClearsNameAndRecordsViolationIfPrefixedNameIsTooLong", func(t *testing.T) {
+
+		state := GCPServiceAccountState{Name: strings.Repeat("a", 65)}
+
+		// act
+		applyNamespacePolicy(&state, NamespacePolicy{NamePrefix: "tenant-a-"}, GCPServiceAccountState{}, true)
+
+		assert.Equal(t, "", state.Name)
+		assert.Equal(t, 1, len(state.PolicyViolations))
+	})
+
+	t.Run("ClearsNameAndRecordsViolationIfPrefixIsInvalid", func(t *testing.T) {
+
+		state := GCPServiceAccountState{Name: "my-application"}
+
+		// act
+		applyNamespacePolicy(&state, NamespacePolicy{NamePrefix: "Tenant_A-"}, GCPServiceAccountState{}, true)
+
+		assert.Equal(t, "", state.Name)
+		assert.Equal(t, 1, len(state.PolicyViolations))
+	})
+
+	t.Run("RemovesPermissionsWithRolesThatAreNotAllowed", func(t *testing.T) {
+
+		state := GCPServiceAccountState{
+			Permissions: []GCPServiceAccountPermission{
+				{Project: "my-project", Role: "roles/storage.objectViewer"},
+				{Project: "my-project", Role: "roles/owner"},
+			},
+		}
+
+		// act
+		applyNamespacePolicy(&state, NamespacePolicy{AllowedRoles: []string{"roles/storage.objectViewer"}}, GCPServiceAccountState{}, true)
+
+		assert.Equal(t, 1, len(state.Permissions))
+		assert.Equal(t, "roles/storage.objectViewer", state.Permissions[0].Role)
+		assert.Equal(t, 1, len(state.PolicyViolations))
+		assert.Contains(t, state.PolicyViolations[0], "roles/owner")
+	})
+
+	t.Run("KeepsAllPermissionsIfAllowedRolesAreNotSet", func(t *testing.T) {
+
+		state := GCPServiceAccountState{
+			Permissions: []GCPServiceAccountPermission{
+				{Project: "my-project", Role: "roles/owner"},
+			},
+		}
+
+		// act
+		applyNamespacePolicy(&state, NamespacePolicy{}, GCPServiceAccountState{}, true)
+
+		assert.Equal(t, 1, len(state.Permissions))
+		assert.Equal(t, 0, len(state.PolicyViolations))
+	})
+
+	t.Run("SetsRestrictionsFromPolicy", func(t *testing.T) {
+
+		state := GCPServiceAccountState{}
+
+		// act
+		applyNamespacePolicy(&state, NamespacePolicy{ServiceAccountProjectID: "tenant-a-accounts", KeysDisabled: true, WorkloadIdentityOnly: true}, GCPServiceAccountState{}, true)
+
+		assert.Equal(t, "tenant-a-accounts", state.ServiceAccountProjectID)
+		assert.True(t, state.KeysDisabled)
+		assert.True(t, state.WorkloadIdentityOnly)
+	})
+}
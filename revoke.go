@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// GCPServiceAccountRevocation records an emergency revocation of all keys of a service account
+type GCPServiceAccountRevocation struct {
+	Token         string   `json:"token"`
+	Initiator     string   `json:"initiator"`
+	RevokedAt     string   `json:"revokedAt"`
+	Status        string   `json:"status,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	RevokedKeyIDs []string `json:"revokedKeyIds,omitempty"`
+}
+
+const (
+	// maxRecordedRevocations is the number of most recent revocations kept in the state
+	maxRecordedRevocations = 5
+
+	// revocationRetryMinutes is how long a failed or interrupted revocation waits before it's retried, to avoid a tight loop on the controller's own secret updates
+	revocationRetryMinutes = 1
+
+	revocationStatusInProgress = "inProgress"
+	revocationStatusFailed     = "failed"
+	revocationStatusSucceeded  = "succeeded"
+)
+
+func makeSecretChangesRevokeKeys(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState) (revoked bool, err error) {
+
+	// a revocation is requested by setting the revoke-now annotation to a token that hasn't been served before, so repeated applies of the same manifest don't revoke again
+	if (*mode == "normal" || *mode == "convenient" || *mode == "rotate_keys_only") &&
+		desiredState.Enabled == "true" &&
+		desiredState.RevokeNowToken != "" &&
+		currentState.FullServiceAccountName != "" &&
+		!isRevocationTokenServed(*currentState, desiredState.RevokeNowToken) &&
+		isRevocationRetryDue(*currentState, desiredState.RevokeNowToken, time.Now()) {
+
+		err = revokeServiceAccountKeys(kubeClientset, iamService, secret, initiator, desiredState, currentState, desiredState.RevokeNowToken)
+		return true, err
+	}
+
+	return false, nil
+}
+
+// isRevocationTokenServed returns true if a revocation with this token has already succeeded; revocations recorded before the status was tracked count as served
+func isRevocationTokenServed(currentState GCPServiceAccountState, token string) bool {
+	for _, revocation := range currentState.Revocations {
+		if revocation.Token == token && (revocation.Status == revocationStatusSucceeded || revocation.Status == "") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isRevocationRetryDue returns false if a revocation with this token has been attempted less than revocationRetryMinutes ago
+func isRevocationRetryDue(currentState GCPServiceAccountState, token string, now time.Time) bool {
+	for _, revocation := range currentState.Revocations {
+		if revocation.Token != token {
+			continue
+		}
+		attemptedAt, err := time.Parse(time.RFC3339, revocation.RevokedAt)
+		if err == nil && now.Sub(attemptedAt) < revocationRetryMinutes*time.Minute {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordRevocationAttempt adds a revocation in progress to the state, or marks an earlier failed attempt with the same token as in progress again
+func recordRevocationAttempt(currentState *GCPServiceAccountState, token, initiator string, now time.Time) {
+	for i := range currentState.Revocations {
+		if currentState.Revocations[i].Token == token {
+			currentState.Revocations[i].Initiator = initiator
+			currentState.Revocations[i].RevokedAt = now.Format(time.RFC3339)
+			currentState.Revocations[i].Status = revocationStatusInProgress
+			currentState.Revocations[i].Error = ""
+			return
+		}
+	}
+
+	currentState.Revocations = append(currentState.Revocations, GCPServiceAccountRevocation{
+		Token:     token,
+		Initiator: initiator,
+		RevokedAt: now.Format(time.RFC3339),
+		Status:    revocationStatusInProgress,
+	})
+	if len(currentState.Revocations) > maxRecordedRevocations {
+		currentState.Revocations = currentState.Revocations[len(currentState.Revocations)-maxRecordedRevocations:]
+	}
+}
+
+// getRevocation returns the revocation with this token recorded in the state
+func getRevocation(currentState *GCPServiceAccountState, token string) *GCPServiceAccountRevocation {
+	for i := range currentState.Revocations {
+		if currentState.Revocations[i].Token == token {
+			return &currentState.Revocations[i]
+		}
+	}
+
+	return nil
+}
+
+// recordRevocationFailure marks the revocation as failed in the state so it's retried, keeping the keys that have been deleted so far
+func recordRevocationFailure(kubeClientset *kubernetes.Clientset, secret *v1.Secret, initiator string, currentState *GCPServiceAccountState, token string, revokedKeyIDs []string, revokeErr error) {
+
+	// reload secret to avoid object has been modified error
+	reloadedSecret, err := kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed recording revocation failure", initiator, secret.Name, secret.Namespace)
+		return
+	}
+
+	if revocation := getRevocation(currentState, token); revocation != nil {
+		revocation.Status = revocationStatusFailed
+		revocation.Error = revokeErr.Error()
+		revocation.RevokedKeyIDs = append(revocation.RevokedKeyIDs, revokedKeyIDs...)
+	}
+
+	err = updateSecret(kubeClientset, reloadedSecret, *currentState, initiator)
+	if err != nil {
+		log.Error().Err(err).Msgf("[%v] Secret %v.%v - Failed recording revocation failure", initiator, secret.Name, secret.Namespace)
+	}
+}
+
+// revokeServiceAccountKeys deletes all user-managed keys of the service account, immediately issues a fresh key into the secret and records the revocation in the state
+func revokeServiceAccountKeys(kubeClientset *kubernetes.Clientset, iamService *GoogleCloudIAMService, secret *v1.Secret, initiator string, desiredState GCPServiceAccountState, currentState *GCPServiceAccountState, token string) (err error) {
+
+	log.Warn().Msgf("[%v] Secret %v.%v - Revoking all keys for service account %v...", initiator, secret.Name, secret.Namespace, currentState.FullServiceAccountName)
+
+	// record the revocation as in progress before revoking; this also 'locks' the secret, because a concurrent update of the same secret version fails; the token only counts as served once all keys are deleted
+	recordRevocationAttempt(currentState, token, initiator, time.Now())
+	currentState.LastAttempt = time.Now().Format(time.RFC3339)
+
+	err = updateSecret(kubeClientset, secret, *currentState, initiator)
+	if err != nil {
+		keyRevocationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+		return err
+	}
+
+	revokedKeyIDs, err := iamService.DeleteAllServiceAccountKeys(currentState.FullServiceAccountName)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed revoking keys for service account %v", currentState.FullServiceAccountName)
+		_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "KeyRevocationFailed", fmt.Sprintf("Revoking keys for service account %v failed, retrying: %v", currentState.FullServiceAccountName, err))
+		keyRevocationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+		recordRevocationFailure(kubeClientset, secret, initiator, currentState, token, revokedKeyIDs, err)
+		return err
+	}
+
+	if desiredState.HmacKeys || currentState.HmacAccessID != "" || len(currentState.IssuedHmacAccessIDs) > 0 {
+		_, err = iamService.DeleteAllHmacKeys(currentState.FullServiceAccountName)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed revoking hmac keys for service account %v", currentState.FullServiceAccountName)
+			_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "KeyRevocationFailed", fmt.Sprintf("Revoking hmac keys for service account %v failed, retrying: %v", currentState.FullServiceAccountName, err))
+			keyRevocationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+			recordRevocationFailure(kubeClientset, secret, initiator, currentState, token, revokedKeyIDs, err)
+			return err
+		}
+	}
+
+	// all keys have been deleted, so the token is served
+	if revocation := getRevocation(currentState, token); revocation != nil {
+		revocation.Status = revocationStatusSucceeded
+		revocation.Error = ""
+		revocation.RevokedKeyIDs = append(revocation.RevokedKeyIDs, revokedKeyIDs...)
+	}
+	currentState.ActiveKeyIDs = nil
+	currentState.IssuedKeyIDs = nil
+	currentState.UnknownKeyIDs = nil
+	currentState.DisabledKeys = nil
+	currentState.HmacAccessID = ""
+	currentState.IssuedHmacAccessIDs = nil
+
+	// store the served token before issuing a new key, so a failure to issue doesn't revoke again, but is picked up by key verification
+	secret, err = kubeClientset.CoreV1().Secrets(secret.Namespace).Get(context.Background(), secret.Name, metav1.GetOptions{})
+	if err != nil {
+		log.Error().Err(err)
+		return err
+	}
+	err = updateSecret(kubeClientset, secret, *currentState, initiator)
+	if err != nil {
+		return err
+	}
+
+	// issue a fresh key; the previous key has been revoked so it isn't kept
+	err = issueServiceAccountKey(kubeClientset, iamService, secret, initiator, desiredState, currentState, false)
+	if err != nil {
+		// make sure the next reconcile detects the secret holds a revoked key and reissues it
+		lastKeyVerificationsMutex.Lock()
+		delete(lastKeyVerifications, secret.Namespace+"/"+secret.Name)
+		lastKeyVerificationsMutex.Unlock()
+
+		_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "KeysRevoked", fmt.Sprintf("Revoked keys %v for service account %v but issuing a new key failed: %v", strings.Join(revokedKeyIDs, ", "), currentState.FullServiceAccountName, err))
+		keyRevocationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+		return err
+	}
+
+	log.Info().Msgf("[%v] Secret %v.%v - Revoked keys %v and issued a new key successfully...", initiator, secret.Name, secret.Namespace, strings.Join(revokedKeyIDs, ", "))
+	_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeWarning, "KeysRevoked", fmt.Sprintf("Revoked keys %v for service account %v and issued a new key", strings.Join(revokedKeyIDs, ", "), currentState.FullServiceAccountName))
+	keyRevocationTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": "secret"}).Inc()
+
+	return nil
+}
+
+// runRevokeCommand revokes all keys for the service account managed by a secret from the command line
+func runRevokeCommand(kubeClientset *kubernetes.Clientset, iamServices *GoogleCloudIAMServices, namespace, secretName string) (err error) {
+
+	secret, err := kubeClientset.CoreV1().Secrets(namespace).Get(context.Background(), secretName, metav1.GetOptions{})
+	if err != nil {
+		return
+	}
+
+	namespaceAnnotations, err := getNamespaceAnnotations(kubeClientset, namespace)
+	if err != nil {
+		return
+	}
+
+	desiredState, err := getDesiredSecretState(secret, namespaceAnnotations)
+	if err != nil {
+		return
+	}
+	currentState, err := getCurrentSecretState(secret)
+	if err != nil {
+		return
+	}
+
+	if currentState.FullServiceAccountName == "" {
+		return fmt.Errorf("Secret %v.%v has no service account managed by this controller", secretName, namespace)
+	}
+
+	iamService, err := iamServices.ForState(namespace, desiredState.ServiceAccountProjectID, currentState.FullServiceAccountName)
+	if err != nil {
+		return
+	}
+
+	return revokeServiceAccountKeys(kubeClientset, iamService, secret, "CLI", desiredState, &currentState, fmt.Sprintf("cli-%v", time.Now().Format(time.RFC3339)))
+}
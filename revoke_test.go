@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRevocationTokenServed(t *testing.T) {
+	t.Run("ReturnsTrueIfRevocationWithTokenSucceeded", func(t *testing.T) {
+
+		currentState := GCPServiceAccountState{
+			Revocations: []GCPServiceAccountRevocation{{Token: "2020-11-23", Status: revocationStatusSucceeded}},
+		}
+
+		// act
+		served := isRevocationTokenServed(currentState, "2020-11-23")
+
+		assert.True(t, served)
+	})
+
+	t.Run("ReturnsTrueIfRevocationWithTokenWasRecordedWithoutStatus", func(t *testing.T) {
+
+		currentState := GCPServiceAccountState{
+			Revocations: []GCPServiceAccountRevocation{{Token: "2020-11-23"}},
+		}
+
+		// act
+		served := isRevocationTokenServed(currentState, "2020-11-23")
+
+		assert.True(t, served)
+	})
+
+	t.Run("ReturnsFalseIfRevocationWithTokenFailed", func(t *testing.T) {
+
+		currentState := GCPServiceAccountState{
+			Revocations: []GCPServiceAccountRevocation{{Token: "2020-11-23", Status: revocationStatusFailed}},
+		}
+
+		// act
+		served := isRevocationTokenServed(currentState, "2020-11-23")
+
+		assert.False(t, served)
+	})
+
+	t.Run("ReturnsFalseIfRevocationWithTokenIsStillInProgress", func(t *testing.T) {
+
+		currentState := GCPServiceAccountState{
+			Revocations: []GCPServiceAccountRevocation{{Token: "2020-11-23", Status: revocationStatusInProgress}},
+		}
+
+		// act
+		served := isRevocationTokenServed(currentState, "2020-11-23")
+
+		assert.False(t, served)
+	})
+}
+
+func TestIsRevocationRetryDue(t *testing.T) {
+	t.Run("ReturnsTrueIfTokenHasNotBeenAttempted", func(t *testing.T) {
+
+		// act
+		due := isRevocationRetryDue(GCPServiceAccountState{}, "2020-11-23", time.Now())
+
+		assert.True(t, due)
+	})
+
+	t.Run("ReturnsFalseIfTokenHasBeenAttemptedRecently", func(t *testing.T) {
+
+		now := time.Now()
+		currentState := GCPServiceAccountState{
+			Revocations: []GCPServiceAccountRevocation{{Token: "2020-11-23", Status: revocationStatusFailed, RevokedAt: now.Add(-30 * time.Second).Format(time.RFC3339)}},
+		}
+
+		// act
+		due := isRevocationRetryDue(currentState, "2020-11-23", now)
+
+		assert.False(t, due)
+	})
+
+	t.Run("ReturnsTrueIfFailedAttemptIsOlderThanRetryInterval", func(t *testing.T) {
+
+		now := time.Now()
+		currentState := GCPServiceAccountState{
+			Revocations: []GCPServiceAccountRevocation{{Token: "2020-11-23", Status: revocationStatusFailed, RevokedAt: now.Add(-2 * time.Minute).Format(time.RFC3339)}},
+		}
+
+		// act
+		due := isRevocationRetryDue(currentState, "2020-11-23", now)
+
+		assert.True(t, due)
+	})
+}
+
+func TestRecordRevocationAttempt(t *testing.T) {
+	t.Run("ReusesEarlierFailedAttemptWithSameToken", func(t *testing.T) {
+
+		currentState := GCPServiceAccountState{
+			Revocations: []GCPServiceAccountRevocation{{Token: "2020-11-23", Status: revocationStatusFailed, Error: "permission denied", RevokedKeyIDs: []string{"abc"}}},
+		}
+
+		// act
+		recordRevocationAttempt(&currentState, "2020-11-23", "POLLER", time.Now())
+
+		assert.Equal(t, 1, len(currentState.Revocations))
+		assert.Equal(t, revocationStatusInProgress, currentState.Revocations[0].Status)
+		assert.Equal(t, "", currentState.Revocations[0].Error)
+		assert.Equal(t, []string{"abc"}, currentState.Revocations[0].RevokedKeyIDs)
+	})
+
+	t.Run("KeepsOnlyMostRecentRevocations", func(t *testing.T) {
+
+		currentState := GCPServiceAccountState{}
+		for _, token := range []string{"1", "2", "3", "4", "5"} {
+			recordRevocationAttempt(&currentState, token, "POLLER", time.Now())
+		}
+
+		// act
+		recordRevocationAttempt(&currentState, "6", "POLLER", time.Now())
+
+		assert.Equal(t, maxRecordedRevocations, len(currentState.Revocations))
+		assert.Equal(t, "2", currentState.Revocations[0].Token)
+		assert.Equal(t, "6", currentState.Revocations[4].Token)
+	})
+}
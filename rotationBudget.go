@@ -0,0 +1,113 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// getRotationDeadline returns when a key is up for rotation, brought forward by a deterministic per-secret fraction of the rotation interval so keys renewed at the same time don't all become due at once; the jitter is taken off the interval so a key never outlives it
+func getRotationDeadline(lastRenewed time.Time, rotationHours, jitterPercentage int, secretKey string) time.Time {
+
+	interval := time.Duration(rotationHours) * time.Hour
+	if jitterPercentage <= 0 {
+		return lastRenewed.Add(interval)
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(secretKey))
+	fraction := float64(hash.Sum32()%10000) / 10000
+
+	jitter := time.Duration(fraction * float64(jitterPercentage) / 100 * float64(interval))
+
+	return lastRenewed.Add(interval - jitter)
+}
+
+// rotationBacklogEntry is a secret waiting for rotation budget
+type rotationBacklogEntry struct {
+	dueSince time.Time
+	lastSeen time.Time
+}
+
+// RotationBudget limits the number of scheduled key rotations per hour across all secrets and queues due rotations in the order they became due
+type RotationBudget struct {
+	maxPerHour int
+	rotations  []time.Time
+	backlog    map[string]rotationBacklogEntry
+	mutex      sync.Mutex
+}
+
+// NewRotationBudget returns a budget for the number of rotations per hour; 0 means no limit
+func NewRotationBudget(maxPerHour int) *RotationBudget {
+	return &RotationBudget{
+		maxPerHour: maxPerHour,
+		backlog:    map[string]rotationBacklogEntry{},
+	}
+}
+
+// Acquire returns true if the secret can rotate now and counts the rotation against the budget; otherwise the secret is queued until budget becomes available for it
+func (budget *RotationBudget) Acquire(secretKey string, dueSince, now time.Time) bool {
+
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	if budget.maxPerHour <= 0 {
+		delete(budget.backlog, secretKey)
+		return true
+	}
+
+	// forget rotations older than an hour and queued secrets that haven't been seen for a while, because they have been deleted or rotated otherwise
+	recentRotations := []time.Time{}
+	for _, rotation := range budget.rotations {
+		if now.Sub(rotation) < time.Hour {
+			recentRotations = append(recentRotations, rotation)
+		}
+	}
+	budget.rotations = recentRotations
+	for key, entry := range budget.backlog {
+		if now.Sub(entry.lastSeen) > 2*time.Hour {
+			delete(budget.backlog, key)
+		}
+	}
+
+	budget.backlog[secretKey] = rotationBacklogEntry{dueSince: dueSince, lastSeen: now}
+
+	remaining := budget.maxPerHour - len(budget.rotations)
+	if remaining <= 0 {
+		return false
+	}
+
+	// serve queued secrets that became due earlier first
+	ahead := 0
+	for key, entry := range budget.backlog {
+		if entry.dueSince.Before(dueSince) || (entry.dueSince.Equal(dueSince) && key < secretKey) {
+			ahead++
+		}
+	}
+	if ahead >= remaining {
+		return false
+	}
+
+	delete(budget.backlog, secretKey)
+	budget.rotations = append(budget.rotations, now)
+
+	return true
+}
+
+// Remove takes a secret out of the queue, for when it's no longer up for rotation
+func (budget *RotationBudget) Remove(secretKey string) {
+
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	delete(budget.backlog, secretKey)
+}
+
+// BacklogSize returns the number of secrets waiting for rotation budget
+func (budget *RotationBudget) BacklogSize() int {
+
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+
+	return len(budget.backlog)
+}
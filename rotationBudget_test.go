@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRotationDeadline(t *testing.T) {
+	t.Run("ReturnsLastRenewedPlusIntervalIfJitterIsDisabled", func(t *testing.T) {
+
+		lastRenewed := time.Date(2020, 11, 23, 10, 0, 0, 0, time.UTC)
+
+		// act
+		deadline := getRotationDeadline(lastRenewed, 168, 0, "my-namespace/my-secret")
+
+		assert.Equal(t, lastRenewed.Add(168*time.Hour), deadline)
+	})
+
+	t.Run("ReturnsDeadlineWithinJitterPercentageOfInterval", func(t *testing.T) {
+
+		lastRenewed := time.Date(2020, 11, 23, 10, 0, 0, 0, time.UTC)
+
+		// act
+		deadline := getRotationDeadline(lastRenewed, 100, 10, "my-namespace/my-secret")
+
+		assert.True(t, deadline.After(lastRenewed.Add(90*time.Hour)))
+		assert.False(t, deadline.After(lastRenewed.Add(100*time.Hour)))
+	})
+
+	t.Run("ReturnsSameDeadlineForSameSecret", func(t *testing.T) {
+
+		lastRenewed := time.Date(2020, 11, 23, 10, 0, 0, 0, time.UTC)
+
+		// act
+		deadline := getRotationDeadline(lastRenewed, 168, 10, "my-namespace/my-secret")
+
+		assert.Equal(t, getRotationDeadline(lastRenewed, 168, 10, "my-namespace/my-secret"), deadline)
+	})
+
+	t.Run("ReturnsDifferentDeadlinesForDifferentSecrets", func(t *testing.T) {
+
+		lastRenewed := time.Date(2020, 11, 23, 10, 0, 0, 0, time.UTC)
+
+		// act
+		deadline := getRotationDeadline(lastRenewed, 168, 10, "my-namespace/my-secret")
+
+		assert.NotEqual(t, getRotationDeadline(lastRenewed, 168, 10, "my-namespace/another-secret"), deadline)
+	})
+}
+
+func TestRotationBudget(t *testing.T) {
+	t.Run("ReturnsTrueIfBudgetIsUnlimited", func(t *testing.T) {
+
+		budget := NewRotationBudget(0)
+		now := time.Now()
+
+		// act
+		acquired := budget.Acquire("my-namespace/my-secret", now, now)
+
+		assert.True(t, acquired)
+		assert.Equal(t, 0, budget.BacklogSize())
+	})
+
+	t.Run("ReturnsFalseAndQueuesSecretIfBudgetIsUsedUp", func(t *testing.T) {
+
+		budget := NewRotationBudget(1)
+		now := time.Now()
+		budget.Acquire("my-namespace/first-secret", now, now)
+
+		// act
+		acquired := budget.Acquire("my-namespace/second-secret", now, now)
+
+		assert.False(t, acquired)
+		assert.Equal(t, 1, budget.BacklogSize())
+	})
+
+	t.Run("ReturnsTrueOnceRotationsAreOlderThanAnHour", func(t *testing.T) {
+
+		budget := NewRotationBudget(1)
+		now := time.Now()
+		budget.Acquire("my-namespace/first-secret", now, now)
+		budget.Acquire("my-namespace/second-secret", now, now)
+
+		// act
+		acquired := budget.Acquire("my-namespace/second-secret", now, now.Add(61*time.Minute))
+
+		assert.True(t, acquired)
+		assert.Equal(t, 0, budget.BacklogSize())
+	})
+
+	t.Run("ReturnsFalseIfSecretsThatBecameDueEarlierAreQueued", func(t *testing.T) {
+
+		budget := NewRotationBudget(1)
+		now := time.Now()
+		budget.Acquire("my-namespace/first-secret", now, now)
+		budget.Acquire("my-namespace/second-secret", now.Add(-2*time.Hour), now)
+		later := now.Add(61 * time.Minute)
+
+		// act
+		acquired := budget.Acquire("my-namespace/third-secret", now.Add(-1*time.Hour), later)
+
+		assert.False(t, acquired)
+		assert.True(t, budget.Acquire("my-namespace/second-secret", now.Add(-2*time.Hour), later))
+	})
+
+	t.Run("RemovesSecretFromBacklog", func(t *testing.T) {
+
+		budget := NewRotationBudget(1)
+		now := time.Now()
+		budget.Acquire("my-namespace/first-secret", now, now)
+		budget.Acquire("my-namespace/second-secret", now, now)
+
+		// act
+		budget.Remove("my-namespace/second-secret")
+
+		assert.Equal(t, 0, budget.BacklogSize())
+	})
+}
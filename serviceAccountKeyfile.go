@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"text/template"
+	"time"
+
+	foundation "github.com/estafette/estafette-foundation"
+)
+
+// ServiceAccountKeyfile represents the json keyfile returned in the private key data of a new service account key
+type ServiceAccountKeyfile struct {
+	Type         string `json:"type"`
+	ProjectID    string `json:"project_id"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	ClientEmail  string `json:"client_email"`
+	ClientID     string `json:"client_id"`
+}
+
+// parseServiceAccountKeyfile deserializes a json keyfile and checks it contains the fields needed by consumers
+func parseServiceAccountKeyfile(keyfileData []byte) (keyfile ServiceAccountKeyfile, err error) {
+
+	err = json.Unmarshal(keyfileData, &keyfile)
+	if err != nil {
+		return
+	}
+
+	if keyfile.ClientEmail == "" || keyfile.PrivateKeyID == "" || keyfile.PrivateKey == "" {
+		return keyfile, fmt.Errorf("Keyfile is missing one or more of the client_email, private_key_id and private_key fields")
+	}
+
+	return
+}
+
+// derivedSecretKeys are the entries written by getDerivedSecretData
+var derivedSecretKeys = []string{"client_email", "project_id", "private_key_id", "private_key", "key-created-at", "key-base64"}
+
+// removeDerivedSecretData removes the entries written by getDerivedSecretData once derived fields are turned off
+func removeDerivedSecretData(data map[string][]byte) {
+	for _, key := range derivedSecretKeys {
+		delete(data, key)
+	}
+}
+
+// getReservedSecretKeys returns the secret entries written by the controller itself, which templates can't be rendered into
+func getReservedSecretKeys(filename string) []string {
+	reservedKeys := []string{filename, filename + ".previous", "hmac-access-id", "hmac-secret", ".dockerconfigjson"}
+	return append(reservedKeys, derivedSecretKeys...)
+}
+
+// getDerivedSecretData returns separate secret entries for the fields of a json keyfile, so they can be used in environment variables via a secretKeyRef
+func getDerivedSecretData(keyfileData []byte, keyCreatedAt string) (data map[string][]byte, err error) {
+
+	keyfile, err := parseServiceAccountKeyfile(keyfileData)
+	if err != nil {
+		return
+	}
+
+	// keep in sync with derivedSecretKeys
+	data = map[string][]byte{
+		"client_email":   []byte(keyfile.ClientEmail),
+		"project_id":     []byte(keyfile.ProjectID),
+		"private_key_id": []byte(keyfile.PrivateKeyID),
+		"private_key":    []byte(keyfile.PrivateKey),
+		"key-created-at": []byte(keyCreatedAt),
+		"key-base64":     []byte(base64.StdEncoding.EncodeToString(keyfileData)),
+	}
+
+	return
+}
+
+// SecretTemplateData is the data available to the templates set in the estafette.io/gcp-service-account-templates annotation
+type SecretTemplateData struct {
+	ServiceAccountKeyfile
+	Keyfile                string
+	KeyfileBase64          string
+	KeyCreatedAt           string
+	Name                   string
+	FullServiceAccountName string
+	Namespace              string
+	SecretName             string
+}
+
+// secretTemplateFuncs are the functions available to the templates set in the estafette.io/gcp-service-account-templates annotation
+var secretTemplateFuncs = template.FuncMap{
+	"base64": func(value string) string {
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	},
+	"json": func(value string) (string, error) {
+		jsonValue, err := json.Marshal(value)
+		return string(jsonValue), err
+	},
+}
+
+// renderSecretTemplates renders each template against the new key and account metadata and returns the results by secret entry name
+func renderSecretTemplates(templates map[string]string, reservedKeys []string, keyfileData []byte, keyCreatedAt, name, fullServiceAccountName, namespace, secretName string) (data map[string][]byte, err error) {
+
+	keyfile, err := parseServiceAccountKeyfile(keyfileData)
+	if err != nil {
+		return
+	}
+
+	templateData := SecretTemplateData{
+		ServiceAccountKeyfile:  keyfile,
+		Keyfile:                string(keyfileData),
+		KeyfileBase64:          base64.StdEncoding.EncodeToString(keyfileData),
+		KeyCreatedAt:           keyCreatedAt,
+		Name:                   name,
+		FullServiceAccountName: fullServiceAccountName,
+		Namespace:              namespace,
+		SecretName:             secretName,
+	}
+
+	data = map[string][]byte{}
+	for key, templateString := range templates {
+		if foundation.StringArrayContains(reservedKeys, key) {
+			return nil, fmt.Errorf("Template for entry %v would overwrite an entry written by this controller", key)
+		}
+
+		tmpl, err := template.New(key).Funcs(secretTemplateFuncs).Option("missingkey=error").Parse(templateString)
+		if err != nil {
+			return nil, fmt.Errorf("Parsing template for entry %v failed: %v", key, err)
+		}
+
+		var rendered bytes.Buffer
+		err = tmpl.Execute(&rendered, templateData)
+		if err != nil {
+			return nil, fmt.Errorf("Rendering template for entry %v failed: %v", key, err)
+		}
+
+		data[key] = rendered.Bytes()
+	}
+
+	return
+}
+
+// DockerConfigJSON represents the content of a kubernetes.io/dockerconfigjson secret
+type DockerConfigJSON struct {
+	Auths map[string]DockerConfigAuth `json:"auths"`
+}
+
+// DockerConfigAuth represents the credentials for a single registry in a DockerConfigJSON
+type DockerConfigAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Auth     string `json:"auth"`
+}
+
+// setRenderedTemplates writes the rendered templates into the secret data and removes the entries of templates that have since been removed, unless the controller writes them itself now; it returns the names of the rendered entries to store in the state
+func setRenderedTemplates(data map[string][]byte, renderedData map[string][]byte, previousTemplateKeys, reservedKeys []string) (templateKeys []string) {
+
+	for _, key := range previousTemplateKeys {
+		if _, ok := renderedData[key]; !ok && !foundation.StringArrayContains(reservedKeys, key) {
+			delete(data, key)
+		}
+	}
+
+	for key, value := range renderedData {
+		data[key] = value
+		templateKeys = append(templateKeys, key)
+	}
+	sort.Strings(templateKeys)
+
+	return
+}
+
+// getTemplatesChecksum returns a checksum of the templates, to detect changes to them since the templates themselves aren't stored in the state
+func getTemplatesChecksum(templates map[string]string) string {
+
+	if len(templates) == 0 {
+		return ""
+	}
+
+	// map keys are marshalled in sorted order, so the checksum doesn't depend on the order of the annotation
+	templatesJSON, _ := json.Marshal(templates)
+
+	return fmt.Sprintf("%x", sha256.Sum256(templatesJSON))
+}
+
+// getDockerConfigJSON returns docker config json with _json_key authentication for each of the registries, for use as image pull secret for Artifact Registry and Container Registry
+func getDockerConfigJSON(keyfileData []byte, registries []string) (data []byte, err error) {
+
+	keyfile, err := parseServiceAccountKeyfile(keyfileData)
+	if err != nil {
+		return
+	}
+
+	dockerConfig := DockerConfigJSON{
+		Auths: map[string]DockerConfigAuth{},
+	}
+	for _, registry := range registries {
+		dockerConfig.Auths[registry] = DockerConfigAuth{
+			Username: "_json_key",
+			Password: string(keyfileData),
+			Email:    keyfile.ClientEmail,
+			Auth:     base64.StdEncoding.EncodeToString([]byte("_json_key:" + string(keyfileData))),
+		}
+	}
+
+	return json.Marshal(dockerConfig)
+}
+
+// verifyServiceAccountKeyfile checks whether the keyfile belongs to the expected account and key and whether a test jwt signed with its private key can be verified with the public key registered for that key
+func verifyServiceAccountKeyfile(keyfileData []byte, serviceAccountEmail, keyID string, publicKeyPEM []byte) (err error) {
+
+	keyfile, err := parseServiceAccountKeyfile(keyfileData)
+	if err != nil {
+		return
+	}
+
+	if keyfile.ClientEmail != serviceAccountEmail {
+		return fmt.Errorf("Keyfile client_email '%v' doesn't match service account email '%v'", keyfile.ClientEmail, serviceAccountEmail)
+	}
+	if keyfile.PrivateKeyID != keyID {
+		return fmt.Errorf("Keyfile private_key_id '%v' doesn't match key id '%v'", keyfile.PrivateKeyID, keyID)
+	}
+
+	privateKey, err := parseRSAPrivateKey([]byte(keyfile.PrivateKey))
+	if err != nil {
+		return
+	}
+	publicKey, err := parseRSAPublicKeyFromCertificate(publicKeyPEM)
+	if err != nil {
+		return
+	}
+
+	// sign a short-lived test jwt locally and verify it with the public key
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": keyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": serviceAccountEmail,
+		"sub": serviceAccountEmail,
+		"aud": "estafette-gcp-service-account",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+	if err != nil {
+		return fmt.Errorf("Signing test jwt with private key failed: %v", err)
+	}
+
+	err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash[:], signature)
+	if err != nil {
+		return fmt.Errorf("Verifying test jwt with public key failed: %v", err)
+	}
+
+	return nil
+}
+
+// parseRSAPrivateKey parses a pem encoded pkcs8 or pkcs1 rsa private key
+func parseRSAPrivateKey(privateKeyPEM []byte) (privateKey *rsa.PrivateKey, err error) {
+
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("Private key is not pem encoded")
+	}
+
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	privateKey, ok := parsedKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key is not a rsa key")
+	}
+
+	return
+}
+
+// parseRSAPublicKeyFromCertificate parses the rsa public key from a pem encoded x509 certificate
+func parseRSAPublicKeyFromCertificate(certificatePEM []byte) (publicKey *rsa.PublicKey, err error) {
+
+	block, _ := pem.Decode(certificatePEM)
+	if block == nil {
+		return nil, fmt.Errorf("Public key certificate is not pem encoded")
+	}
+
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return
+	}
+
+	publicKey, ok := certificate.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Public key is not a rsa key")
+	}
+
+	return
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ServiceAccountProjectMapping maps the namespaces matching a pattern to the project their service accounts are created in
+type ServiceAccountProjectMapping struct {
+	NamespacePattern string
+	ProjectID        string
+}
+
+// parseServiceAccountProjectMappings parses a comma-separated list of '<namespace pattern>=<project id>' pairs, where the pattern supports shell wildcards like 'team-a-*'
+func parseServiceAccountProjectMappings(value string) (mappings []ServiceAccountProjectMapping, err error) {
+
+	for _, item := range splitCommaSeparatedList(value) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Project mapping '%v' isn't in the form '<namespace pattern>=<project id>'", item)
+		}
+
+		mapping := ServiceAccountProjectMapping{
+			NamespacePattern: strings.TrimSpace(parts[0]),
+			ProjectID:        strings.TrimSpace(parts[1]),
+		}
+
+		if _, err = path.Match(mapping.NamespacePattern, ""); err != nil {
+			return nil, fmt.Errorf("Project mapping '%v' has an invalid namespace pattern: %v", item, err)
+		}
+
+		mappings = append(mappings, mapping)
+	}
+
+	return
+}
+
+// getServiceAccountProjectID returns the project set in the namespace annotation, or else the project of the first mapping matching the namespace, or else the default project
+func getServiceAccountProjectID(mappings []ServiceAccountProjectMapping, defaultProjectID, namespace, annotatedProjectID string) string {
+
+	if annotatedProjectID != "" {
+		return annotatedProjectID
+	}
+
+	for _, mapping := range mappings {
+		if matched, _ := path.Match(mapping.NamespacePattern, namespace); matched {
+			return mapping.ProjectID
+		}
+	}
+
+	return defaultProjectID
+}
+
+// ErrServiceAccountProjectNotAllowed is returned when a state refers to a service account in a project that isn't the default project, one of its pool, a mapped project or the project set on the namespace
+var ErrServiceAccountProjectNotAllowed = errors.New("The service account isn't in a project this controller manages service accounts in for the namespace")
+
+// GoogleCloudIAMServices keeps a GoogleCloudIAMService per service account project, so each namespace's accounts are created in and validated against its own project
+type GoogleCloudIAMServices struct {
+	defaultProjectID             string
+	defaultProjectPool           []string
+	maxServiceAccountsPerProject int
+	localProjectID               string
+	mappings                     []ServiceAccountProjectMapping
+	newService                   func(serviceAccountProjectID string, serviceAccountProjectPool []string, maxServiceAccountsPerProject int, localProjectID string) (*GoogleCloudIAMService, error)
+
+	services map[string]*GoogleCloudIAMService
+	mutex    sync.Mutex
+}
+
+// NewGoogleCloudIAMServices returns an initialized GoogleCloudIAMServices with a service for the default project and its pool, and for each mapped project
+func NewGoogleCloudIAMServices(defaultProjectID string, defaultProjectPool []string, maxServiceAccountsPerProject int, localProjectID string, mappings []ServiceAccountProjectMapping) (*GoogleCloudIAMServices, error) {
+
+	iamServices := &GoogleCloudIAMServices{
+		defaultProjectID:             defaultProjectID,
+		defaultProjectPool:           defaultProjectPool,
+		maxServiceAccountsPerProject: maxServiceAccountsPerProject,
+		localProjectID:               localProjectID,
+		mappings:                     mappings,
+		newService:                   NewGoogleCloudIAMService,
+	}
+
+	err := iamServices.Reinitialize()
+	if err != nil {
+		return nil, err
+	}
+
+	return iamServices, nil
+}
+
+// Reinitialize recreates the services for the default project and each mapped project, for example after the credentials have changed; services for projects only set in namespace annotations are recreated when next needed
+func (iamServices *GoogleCloudIAMServices) Reinitialize() error {
+
+	services := map[string]*GoogleCloudIAMService{}
+
+	for _, projectID := range iamServices.getConfiguredProjectIDs() {
+		// the revoke command runs without a default project and only uses the project its service account has been created in
+		if _, ok := services[projectID]; ok || projectID == "" {
+			continue
+		}
+		service, err := iamServices.newService(projectID, iamServices.getProjectPool(projectID), iamServices.maxServiceAccountsPerProject, iamServices.localProjectID)
+		if err != nil {
+			return err
+		}
+		services[projectID] = service
+	}
+
+	iamServices.mutex.Lock()
+	defer iamServices.mutex.Unlock()
+
+	iamServices.services = services
+
+	return nil
+}
+
+// ForNamespace returns the service for the project the service accounts of a namespace belong in
+func (iamServices *GoogleCloudIAMServices) ForNamespace(namespace, annotatedProjectID string) (*GoogleCloudIAMService, error) {
+	return iamServices.ForProject(getServiceAccountProjectID(iamServices.mappings, iamServices.defaultProjectID, namespace, annotatedProjectID))
+}
+
+// ForState returns the service for the project an existing service account has been created in, so changing a namespace's project doesn't strand its existing accounts, or else the service for the namespace's project to create a new account in
+func (iamServices *GoogleCloudIAMServices) ForState(namespace, annotatedProjectID, fullServiceAccountName string) (*GoogleCloudIAMService, error) {
+	if fullServiceAccountName != "" {
+		return iamServices.ForServiceAccount(annotatedProjectID, fullServiceAccountName)
+	}
+
+	return iamServices.ForNamespace(namespace, annotatedProjectID)
+}
+
+// ForServiceAccount returns the service for the project or pool a service account has been created in; since the service account name comes from the state, which can be edited, only the configured projects and the project set on the namespace are allowed
+func (iamServices *GoogleCloudIAMServices) ForServiceAccount(annotatedProjectID, fullServiceAccountName string) (*GoogleCloudIAMService, error) {
+
+	projectID, _, err := getProjectIDAndServiceAccountEmail(fullServiceAccountName)
+	if err != nil {
+		return nil, err
+	}
+
+	iamServices.mutex.Lock()
+	for _, configuredProjectID := range iamServices.getConfiguredProjectIDs() {
+		if service, ok := iamServices.services[configuredProjectID]; ok && service.ownsProject(projectID) {
+			iamServices.mutex.Unlock()
+			return service, nil
+		}
+	}
+	iamServices.mutex.Unlock()
+
+	if annotatedProjectID != "" && projectID == annotatedProjectID {
+		return iamServices.ForProject(projectID)
+	}
+
+	return nil, ErrServiceAccountProjectNotAllowed
+}
+
+// ForProject returns the service for a project, creating it if it's not one of the default or mapped projects
+func (iamServices *GoogleCloudIAMServices) ForProject(projectID string) (*GoogleCloudIAMService, error) {
+
+	iamServices.mutex.Lock()
+	defer iamServices.mutex.Unlock()
+
+	if service, ok := iamServices.services[projectID]; ok {
+		return service, nil
+	}
+
+	service, err := iamServices.newService(projectID, iamServices.getProjectPool(projectID), iamServices.maxServiceAccountsPerProject, iamServices.localProjectID)
+	if err != nil {
+		return nil, err
+	}
+	iamServices.services[projectID] = service
+
+	return service, nil
+}
+
+// getConfiguredProjectIDs returns the default project and the mapped projects, which service accounts can be managed in for any namespace
+func (iamServices *GoogleCloudIAMServices) getConfiguredProjectIDs() []string {
+
+	projectIDs := []string{iamServices.defaultProjectID}
+	for _, mapping := range iamServices.mappings {
+		projectIDs = append(projectIDs, mapping.ProjectID)
+	}
+
+	return projectIDs
+}
+
+// getProjectPool returns the further projects to create service accounts in once a project is full; only the default project has a pool
+func (iamServices *GoogleCloudIAMServices) getProjectPool(projectID string) []string {
+	if projectID == iamServices.defaultProjectID {
+		return iamServices.defaultProjectPool
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseServiceAccountProjectMappings(t *testing.T) {
+	t.Run("ReturnsNoMappingsForEmptyValue", func(t *testing.T) {
+
+		// act
+		mappings, err := parseServiceAccountProjectMappings("")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(mappings))
+	})
+
+	t.Run("ReturnsMappingForEachPair", func(t *testing.T) {
+
+		// act
+		mappings, err := parseServiceAccountProjectMappings("team-a-*=team-a-service-accounts, team-b = team-b-service-accounts")
+
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(mappings))
+		assert.Equal(t, "team-a-*", mappings[0].NamespacePattern)
+		assert.Equal(t, "team-a-service-accounts", mappings[0].ProjectID)
+		assert.Equal(t, "team-b", mappings[1].NamespacePattern)
+		assert.Equal(t, "team-b-service-accounts", mappings[1].ProjectID)
+	})
+
+	t.Run("ReturnsErrorIfPairHasNoProject", func(t *testing.T) {
+
+		// act
+		_, err := parseServiceAccountProjectMappings("team-a-*")
+
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ReturnsErrorIfPatternIsInvalid", func(t *testing.T) {
+
+		// act
+		_, err := parseServiceAccountProjectMappings("team-[a=team-a-service-accounts")
+
+		assert.NotNil(t, err)
+	})
+}
+
+func TestGetServiceAccountProjectID(t *testing.T) {
+
+	mappings := []ServiceAccountProjectMapping{
+		{NamespacePattern: "team-a-*", ProjectID: "team-a-service-accounts"},
+		{NamespacePattern: "team-*", ProjectID: "teams-service-accounts"},
+	}
+
+	t.Run("ReturnsProjectOfFirstMatchingPattern", func(t *testing.T) {
+
+		// act
+		projectID := getServiceAccountProjectID(mappings, "my-service-account-container", "team-a-production", "")
+
+		assert.Equal(t, "team-a-service-accounts", projectID)
+	})
+
+	t.Run("ReturnsDefaultProjectIfNoPatternMatches", func(t *testing.T) {
+
+		// act
+		projectID := getServiceAccountProjectID(mappings, "my-service-account-container", "kube-system", "")
+
+		assert.Equal(t, "my-service-account-container", projectID)
+	})
+
+	t.Run("ReturnsAnnotatedProjectOverMatchingPattern", func(t *testing.T) {
+
+		// act
+		projectID := getServiceAccountProjectID(mappings, "my-service-account-container", "team-a-production", "team-a-production-service-accounts")
+
+		assert.Equal(t, "team-a-production-service-accounts", projectID)
+	})
+}
+
+func TestGoogleCloudIAMServices(t *testing.T) {
+
+	newTestIAMServices := func() *GoogleCloudIAMServices {
+		return &GoogleCloudIAMServices{
+			defaultProjectID:   "my-service-account-container",
+			localProjectID:     "my-dev-project",
+			mappings:           []ServiceAccountProjectMapping{{NamespacePattern: "team-a-*", ProjectID: "team-a-service-accounts"}},
+			defaultProjectPool: []string{"my-service-account-container-2"},
+			newService: func(serviceAccountProjectID string, serviceAccountProjectPool []string, maxServiceAccountsPerProject int, localProjectID string) (*GoogleCloudIAMService, error) {
+				return &GoogleCloudIAMService{serviceAccountProjectID: serviceAccountProjectID, serviceAccountProjectPool: serviceAccountProjectPool, localProjectID: localProjectID}, nil
+			},
+		}
+	}
+
+	t.Run("ReturnsServiceForMappedProjectOfNamespace", func(t *testing.T) {
+
+		iamServices := newTestIAMServices()
+		err := iamServices.Reinitialize()
+		assert.Nil(t, err)
+
+		// act
+		iamService, err := iamServices.ForNamespace("team-a-production", "")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "team-a-service-accounts", iamService.serviceAccountProjectID)
+		assert.True(t, iamService.validateFullServiceAccountName("projects/team-a-service-accounts/serviceAccounts/my-application-abcd@team-a-service-accounts.iam.gserviceaccount.com"))
+		assert.False(t, iamService.validateFullServiceAccountName("projects/my-service-account-container/serviceAccounts/my-application-abcd@my-service-account-container.iam.gserviceaccount.com"))
+	})
+
+	t.Run("ReturnsServiceForProjectOfServiceAccount", func(t *testing.T) {
+
+		iamServices := newTestIAMServices()
+		err := iamServices.Reinitialize()
+		assert.Nil(t, err)
+
+		// act
+		iamService, err := iamServices.ForServiceAccount("", "projects/my-service-account-container/serviceAccounts/my-application-abcd@my-service-account-container.iam.gserviceaccount.com")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "my-service-account-container", iamService.serviceAccountProjectID)
+	})
+
+	t.Run("CreatesServiceForProjectOnlySetInNamespaceAnnotation", func(t *testing.T) {
+
+		iamServices := newTestIAMServices()
+		err := iamServices.Reinitialize()
+		assert.Nil(t, err)
+
+		// act
+		iamService, err := iamServices.ForNamespace("team-b", "team-b-service-accounts")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "team-b-service-accounts", iamService.serviceAccountProjectID)
+		assert.Equal(t, 3, len(iamServices.services))
+	})
+
+	t.Run("ReturnsServiceForProjectOfExistingServiceAccountOverMappedProject", func(t *testing.T) {
+
+		iamServices := newTestIAMServices()
+		err := iamServices.Reinitialize()
+		assert.Nil(t, err)
+
+		// act
+		iamService, err := iamServices.ForState("team-a-production", "", "projects/my-service-account-container/serviceAccounts/my-application-abcd@my-service-account-container.iam.gserviceaccount.com")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "my-service-account-container", iamService.serviceAccountProjectID)
+	})
+
+	t.Run("ReturnsServiceForMappedProjectIfThereIsNoServiceAccountYet", func(t *testing.T) {
+
+		iamServices := newTestIAMServices()
+		err := iamServices.Reinitialize()
+		assert.Nil(t, err)
+
+		// act
+		iamService, err := iamServices.ForState("team-a-production", "", "")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "team-a-service-accounts", iamService.serviceAccountProjectID)
+	})
+
+	t.Run("ReturnsDefaultServiceForServiceAccountInPoolProject", func(t *testing.T) {
+
+		iamServices := newTestIAMServices()
+		err := iamServices.Reinitialize()
+		assert.Nil(t, err)
+
+		// act
+		iamService, err := iamServices.ForServiceAccount("", "projects/my-service-account-container-2/serviceAccounts/my-application-abcd@my-service-account-container-2.iam.gserviceaccount.com")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "my-service-account-container", iamService.serviceAccountProjectID)
+		assert.Equal(t, 2, len(iamServices.services))
+	})
+
+	t.Run("ReturnsServiceForServiceAccountInProjectSetOnNamespace", func(t *testing.T) {
+
+		iamServices := newTestIAMServices()
+		err := iamServices.Reinitialize()
+		assert.Nil(t, err)
+
+		// act
+		iamService, err := iamServices.ForServiceAccount("team-b-service-accounts", "projects/team-b-service-accounts/serviceAccounts/my-application-abcd@team-b-service-accounts.iam.gserviceaccount.com")
+
+		assert.Nil(t, err)
+		assert.Equal(t, "team-b-service-accounts", iamService.serviceAccountProjectID)
+	})
+
+	t.Run("ReturnsErrorForServiceAccountInProjectThatIsNotConfiguredOrSetOnNamespace", func(t *testing.T) {
+
+		iamServices := newTestIAMServices()
+		err := iamServices.Reinitialize()
+		assert.Nil(t, err)
+
+		// act
+		_, err = iamServices.ForState("team-b", "team-b-service-accounts", "projects/someone-elses-project/serviceAccounts/my-application-abcd@someone-elses-project.iam.gserviceaccount.com")
+
+		assert.Equal(t, ErrServiceAccountProjectNotAllowed, err)
+		assert.Equal(t, 2, len(iamServices.services))
+	})
+
+	t.Run("ReturnsErrorForServiceAccountInProjectOnlySetOnAnotherNamespace", func(t *testing.T) {
+
+		iamServices := newTestIAMServices()
+		err := iamServices.Reinitialize()
+		assert.Nil(t, err)
+		_, err = iamServices.ForNamespace("team-b", "team-b-service-accounts")
+		assert.Nil(t, err)
+
+		// act
+		_, err = iamServices.ForServiceAccount("", "projects/team-b-service-accounts/serviceAccounts/my-application-abcd@team-b-service-accounts.iam.gserviceaccount.com")
+
+		assert.Equal(t, ErrServiceAccountProjectNotAllowed, err)
+	})
+}
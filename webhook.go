@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// annotationGCPServiceAccountSecret is set on pods to the name of the managed secret to inject its credentials
+	annotationGCPServiceAccountSecret string = "estafette.io/gcp-service-account-secret"
+
+	injectedVolumeName string = "estafette-gcp-service-account"
+	injectedMountPath  string = "/gcp-service-account"
+
+	// an admission review holds both the object and the old object, each of which can be at most about 1.5MiB
+	maxAdmissionReviewBytes int64 = 4 * 1024 * 1024
+)
+
+// JSONPatchOperation represents a single json patch operation returned by the mutating webhook
+type JSONPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// startWebhookServer serves the admission webhooks over tls; the certificate is loaded and the port bound before returning, so a misconfiguration fails at startup instead of in the background
+func startWebhookServer(kubeClientset *kubernetes.Clientset) error {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate-pods", handleAdmissionReview(func(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+		return mutatePod(kubeClientset, request)
+	}))
+	mux.HandleFunc("/validate", handleAdmissionReview(validateObject))
+
+	certificate, err := tls.LoadX509KeyPair(*webhookTLSCertFile, *webhookTLSKeyFile)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", *webhookPort))
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           mux,
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{certificate}},
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	go func() {
+		log.Info().Msgf("Serving admission webhooks on port %v...", *webhookPort)
+		err := server.ServeTLS(listener, "", "")
+		if err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Msg("Serving admission webhooks failed")
+		}
+	}()
+
+	return nil
+}
+
+// handleAdmissionReview decodes an admission review, passes its request to the review function and writes back the response
+func handleAdmissionReview(review func(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdmissionReviewBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var admissionReview admissionv1.AdmissionReview
+		err = json.Unmarshal(body, &admissionReview)
+		if err != nil || admissionReview.Request == nil {
+			http.Error(w, "Request body is not an admission review", http.StatusBadRequest)
+			return
+		}
+
+		response := review(admissionReview.Request)
+		response.UID = admissionReview.Request.UID
+		admissionReview.Response = response
+		admissionReview.Request = nil
+
+		responseBody, err := json.Marshal(admissionReview)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(responseBody)
+	}
+}
+
+// getDeniedAdmissionResponse returns a response rejecting the request with the message shown to the user
+func getDeniedAdmissionResponse(message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: message,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
+
+// mutatePod injects the keyfile of the managed secret set in the pod's annotation into all of its containers
+func mutatePod(kubeClientset *kubernetes.Clientset, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+
+	var pod v1.Pod
+	err := json.Unmarshal(request.Object.Raw, &pod)
+	if err != nil {
+		return getDeniedAdmissionResponse(fmt.Sprintf("Pod can't be deserialized: %v", err))
+	}
+
+	secretName, ok := pod.ObjectMeta.Annotations[annotationGCPServiceAccountSecret]
+	if !ok || secretName == "" {
+		return &admissionv1.AdmissionResponse{Allowed: true}
+	}
+
+	secret, err := kubeClientset.CoreV1().Secrets(request.Namespace).Get(context.Background(), secretName, metav1.GetOptions{})
+	if err != nil {
+		return getDeniedAdmissionResponse(fmt.Sprintf("Secret %v set in annotation %v can't be retrieved: %v", secretName, annotationGCPServiceAccountSecret, err))
+	}
+
+	namespaceAnnotations, err := getNamespaceAnnotations(kubeClientset, request.Namespace)
+	if err != nil {
+		return getDeniedAdmissionResponse(fmt.Sprintf("Namespace %v can't be retrieved to determine the keyfile name: %v", request.Namespace, err))
+	}
+
+	// only the filename is needed here, other annotations that can't be parsed are reported by the controller
+	desiredState, _ := getDesiredSecretState(secret, namespaceAnnotations)
+	if desiredState.Enabled != "true" {
+		return getDeniedAdmissionResponse(fmt.Sprintf("Secret %v set in annotation %v isn't managed by estafette-gcp-service-account; annotate it with %v: 'true'", secretName, annotationGCPServiceAccountSecret, annotationGCPServiceAccount))
+	}
+
+	patch, err := json.Marshal(getCredentialsInjectionPatch(pod, secretName, desiredState.Filename))
+	if err != nil {
+		return getDeniedAdmissionResponse(fmt.Sprintf("Patch for injecting credentials can't be serialized: %v", err))
+	}
+
+	log.Info().Msgf("Injecting keyfile from secret %v.%v into pod %v%v...", secretName, request.Namespace, pod.Name, pod.GenerateName)
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	return &admissionv1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patch,
+		PatchType: &patchType,
+	}
+}
+
+// getCredentialsInjectionPatch returns the json patch operations that mount the secret in each container and point GOOGLE_APPLICATION_CREDENTIALS at the keyfile, leaving anything that's already set untouched
+func getCredentialsInjectionPatch(pod v1.Pod, secretName, filename string) (operations []JSONPatchOperation) {
+
+	operations = []JSONPatchOperation{}
+
+	volume := v1.Volume{
+		Name: injectedVolumeName,
+		VolumeSource: v1.VolumeSource{
+			Secret: &v1.SecretVolumeSource{SecretName: secretName},
+		},
+	}
+	volumeExists := false
+	for _, existingVolume := range pod.Spec.Volumes {
+		if existingVolume.Name == injectedVolumeName {
+			volumeExists = true
+		}
+	}
+	if !volumeExists {
+		if len(pod.Spec.Volumes) == 0 {
+			operations = append(operations, JSONPatchOperation{Op: "add", Path: "/spec/volumes", Value: []v1.Volume{volume}})
+		} else {
+			operations = append(operations, JSONPatchOperation{Op: "add", Path: "/spec/volumes/-", Value: volume})
+		}
+	}
+
+	volumeMount := v1.VolumeMount{
+		Name:      injectedVolumeName,
+		MountPath: injectedMountPath,
+		ReadOnly:  true,
+	}
+	env := v1.EnvVar{
+		Name:  "GOOGLE_APPLICATION_CREDENTIALS",
+		Value: path.Join(injectedMountPath, filename),
+	}
+
+	// init containers often need the credentials as well, for example to fetch configuration
+	operations = append(operations, getContainerInjectionPatch("/spec/initContainers", pod.Spec.InitContainers, volumeMount, env)...)
+	operations = append(operations, getContainerInjectionPatch("/spec/containers", pod.Spec.Containers, volumeMount, env)...)
+
+	return
+}
+
+// getContainerInjectionPatch returns the json patch operations mounting the secret and setting the credentials env var in each of the containers at the path that don't have them yet
+func getContainerInjectionPatch(containersPath string, containers []v1.Container, volumeMount v1.VolumeMount, env v1.EnvVar) (operations []JSONPatchOperation) {
+
+	for i, container := range containers {
+
+		mountExists := false
+		for _, existingMount := range container.VolumeMounts {
+			if existingMount.Name == injectedVolumeName || existingMount.MountPath == injectedMountPath {
+				mountExists = true
+			}
+		}
+		if !mountExists {
+			if len(container.VolumeMounts) == 0 {
+				operations = append(operations, JSONPatchOperation{Op: "add", Path: fmt.Sprintf("%v/%v/volumeMounts", containersPath, i), Value: []v1.VolumeMount{volumeMount}})
+			} else {
+				operations = append(operations, JSONPatchOperation{Op: "add", Path: fmt.Sprintf("%v/%v/volumeMounts/-", containersPath, i), Value: volumeMount})
+			}
+		}
+
+		envExists := false
+		for _, existingEnv := range container.Env {
+			if existingEnv.Name == env.Name {
+				envExists = true
+			}
+		}
+		if !envExists {
+			if len(container.Env) == 0 {
+				operations = append(operations, JSONPatchOperation{Op: "add", Path: fmt.Sprintf("%v/%v/env", containersPath, i), Value: []v1.EnvVar{env}})
+			} else {
+				operations = append(operations, JSONPatchOperation{Op: "add", Path: fmt.Sprintf("%v/%v/env/-", containersPath, i), Value: env})
+			}
+		}
+	}
+
+	return
+}
+
+// validateObject rejects secrets and service accounts with malformed or disallowed estafette.io/gcp-service-account* annotations
+func validateObject(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+
+	var object, oldObject metav1.PartialObjectMetadata
+	err := json.Unmarshal(request.Object.Raw, &object)
+	if err != nil {
+		return getDeniedAdmissionResponse(fmt.Sprintf("%v can't be deserialized: %v", request.Kind.Kind, err))
+	}
+
+	// on updates only validate the annotations that change, so pre-existing issues don't block unrelated changes like the controller storing its state or a revoke-now
+	var changedKeys []string
+	if request.Operation == admissionv1.Update && len(request.OldObject.Raw) > 0 {
+		err = json.Unmarshal(request.OldObject.Raw, &oldObject)
+		if err == nil {
+			changedKeys = getChangedControllerAnnotations(oldObject.Annotations, object.Annotations)
+			if len(changedKeys) == 0 {
+				return &admissionv1.AdmissionResponse{Allowed: true}
+			}
+		}
+	}
+
+	var messages []string
+	switch request.Kind.Kind {
+	case "Secret":
+		messages = validateSecretAnnotations(object.Annotations, changedKeys)
+	case "ServiceAccount":
+		messages = validateServiceAccountAnnotations(object.Annotations, changedKeys)
+	}
+
+	if len(messages) > 0 {
+		log.Info().Msgf("Rejecting %v %v.%v with invalid annotations: %v", request.Kind.Kind, object.Name, request.Namespace, strings.Join(messages, "; "))
+		return getDeniedAdmissionResponse(strings.Join(messages, "; "))
+	}
+
+	return &admissionv1.AdmissionResponse{Allowed: true}
+}
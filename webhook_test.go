@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestGetCredentialsInjectionPatch(t *testing.T) {
+	t.Run("ReturnsOperationsCreatingVolumesVolumeMountsAndEnvIfMissing", func(t *testing.T) {
+
+		pod := v1.Pod{
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{
+					{Name: "my-application"},
+				},
+			},
+		}
+
+		// act
+		operations := getCredentialsInjectionPatch(pod, "my-application-gcp-service-account", "service-account-key.json")
+
+		assert.Equal(t, 3, len(operations))
+		assert.Equal(t, "/spec/volumes", operations[0].Path)
+		assert.Equal(t, "my-application-gcp-service-account", operations[0].Value.([]v1.Volume)[0].Secret.SecretName)
+		assert.Equal(t, "/spec/containers/0/volumeMounts", operations[1].Path)
+		assert.Equal(t, "/gcp-service-account", operations[1].Value.([]v1.VolumeMount)[0].MountPath)
+		assert.Equal(t, "/spec/containers/0/env", operations[2].Path)
+		assert.Equal(t, "/gcp-service-account/service-account-key.json", operations[2].Value.([]v1.EnvVar)[0].Value)
+	})
+
+	t.Run("ReturnsOperationsForInitContainersAsWell", func(t *testing.T) {
+
+		pod := v1.Pod{
+			Spec: v1.PodSpec{
+				InitContainers: []v1.Container{
+					{Name: "fetch-config"},
+				},
+				Containers: []v1.Container{
+					{Name: "my-application"},
+				},
+			},
+		}
+
+		// act
+		operations := getCredentialsInjectionPatch(pod, "my-application-gcp-service-account", "service-account-key.json")
+
+		assert.Equal(t, 5, len(operations))
+		assert.Equal(t, "/spec/initContainers/0/volumeMounts", operations[1].Path)
+		assert.Equal(t, "/spec/initContainers/0/env", operations[2].Path)
+		assert.Equal(t, "/spec/containers/0/volumeMounts", operations[3].Path)
+		assert.Equal(t, "/spec/containers/0/env", operations[4].Path)
+	})
+
+	t.Run("ReturnsOperationsAppendingToExistingVolumesVolumeMountsAndEnv", func(t *testing.T) {
+
+		pod := v1.Pod{
+			Spec: v1.PodSpec{
+				Volumes: []v1.Volume{
+					{Name: "config"},
+				},
+				Containers: []v1.Container{
+					{
+						Name:         "my-application",
+						VolumeMounts: []v1.VolumeMount{{Name: "config", MountPath: "/config"}},
+						Env:          []v1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}},
+					},
+				},
+			},
+		}
+
+		// act
+		operations := getCredentialsInjectionPatch(pod, "my-application-gcp-service-account", "key.json")
+
+		assert.Equal(t, 3, len(operations))
+		assert.Equal(t, "/spec/volumes/-", operations[0].Path)
+		assert.Equal(t, "/spec/containers/0/volumeMounts/-", operations[1].Path)
+		assert.Equal(t, "/spec/containers/0/env/-", operations[2].Path)
+		assert.Equal(t, "/gcp-service-account/key.json", operations[2].Value.(v1.EnvVar).Value)
+	})
+
+	t.Run("ReturnsNoOperationsForWhatIsAlreadySet", func(t *testing.T) {
+
+		pod := v1.Pod{
+			Spec: v1.PodSpec{
+				Volumes: []v1.Volume{
+					{Name: "estafette-gcp-service-account"},
+				},
+				Containers: []v1.Container{
+					{
+						Name:         "my-application",
+						VolumeMounts: []v1.VolumeMount{{Name: "estafette-gcp-service-account", MountPath: "/gcp-service-account"}},
+						Env:          []v1.EnvVar{{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/somewhere/else.json"}},
+					},
+				},
+			},
+		}
+
+		// act
+		operations := getCredentialsInjectionPatch(pod, "my-application-gcp-service-account", "service-account-key.json")
+
+		assert.Equal(t, 0, len(operations))
+	})
+
+	t.Run("ReturnsOperationsForEachContainer", func(t *testing.T) {
+
+		pod := v1.Pod{
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{
+					{Name: "my-application"},
+					{Name: "sidecar"},
+				},
+			},
+		}
+
+		// act
+		operations := getCredentialsInjectionPatch(pod, "my-application-gcp-service-account", "service-account-key.json")
+
+		assert.Equal(t, 5, len(operations))
+		assert.Equal(t, "/spec/containers/1/volumeMounts", operations[3].Path)
+		assert.Equal(t, "/spec/containers/1/env", operations[4].Path)
+	})
+}
+
+func TestHandleAdmissionReview(t *testing.T) {
+	t.Run("ReturnsResponseWithRequestUID", func(t *testing.T) {
+
+		handler := handleAdmissionReview(func(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+			return &admissionv1.AdmissionResponse{Allowed: true}
+		})
+		body, _ := json.Marshal(admissionv1.AdmissionReview{
+			Request: &admissionv1.AdmissionRequest{UID: types.UID("abc-123")},
+		})
+		recorder := httptest.NewRecorder()
+
+		// act
+		handler(recorder, httptest.NewRequest("POST", "/mutate-pods", bytes.NewReader(body)))
+
+		var admissionReview admissionv1.AdmissionReview
+		err := json.Unmarshal(recorder.Body.Bytes(), &admissionReview)
+		assert.Nil(t, err)
+		assert.Equal(t, types.UID("abc-123"), admissionReview.Response.UID)
+		assert.True(t, admissionReview.Response.Allowed)
+		assert.Nil(t, admissionReview.Request)
+	})
+
+	t.Run("ReturnsBadRequestIfBodyIsNotAnAdmissionReview", func(t *testing.T) {
+
+		handler := handleAdmissionReview(func(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+			return &admissionv1.AdmissionResponse{Allowed: true}
+		})
+		recorder := httptest.NewRecorder()
+
+		// act
+		handler(recorder, httptest.NewRequest("POST", "/mutate-pods", bytes.NewReader([]byte("not json"))))
+
+		assert.Equal(t, 400, recorder.Code)
+	})
+
+	t.Run("ReturnsBadRequestIfBodyIsTooLarge", func(t *testing.T) {
+
+		handler := handleAdmissionReview(func(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+			return &admissionv1.AdmissionResponse{Allowed: true}
+		})
+		recorder := httptest.NewRecorder()
+
+		// act
+		handler(recorder, httptest.NewRequest("POST", "/mutate-pods", bytes.NewReader(make([]byte, maxAdmissionReviewBytes+1))))
+
+		assert.Equal(t, 400, recorder.Code)
+	})
+}
+
+func TestValidateObject(t *testing.T) {
+
+	getSecretRaw := func(annotations map[string]string) runtime.RawExtension {
+		raw, _ := json.Marshal(v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "my-secret", Annotations: annotations}})
+		return runtime.RawExtension{Raw: raw}
+	}
+
+	t.Run("ReturnsDeniedForSecretWithInvalidAnnotations", func(t *testing.T) {
+
+		request := &admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+			Operation: admissionv1.Create,
+			Object: getSecretRaw(map[string]string{
+				"estafette.io/gcp-service-account":      "true",
+				"estafette.io/gcp-service-account-name": "app",
+			}),
+		}
+
+		// act
+		response := validateObject(request)
+
+		assert.False(t, response.Allowed)
+		assert.Contains(t, response.Result.Message, "at least 5 characters")
+	})
+
+	t.Run("ReturnsAllowedForSecretWithValidAnnotations", func(t *testing.T) {
+
+		request := &admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+			Operation: admissionv1.Create,
+			Object: getSecretRaw(map[string]string{
+				"estafette.io/gcp-service-account":      "true",
+				"estafette.io/gcp-service-account-name": "my-application",
+			}),
+		}
+
+		// act
+		response := validateObject(request)
+
+		assert.True(t, response.Allowed)
+	})
+
+	t.Run("ReturnsAllowedForUpdateThatOnlyChangesState", func(t *testing.T) {
+
+		request := &admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+			Operation: admissionv1.Update,
+			OldObject: getSecretRaw(map[string]string{
+				"estafette.io/gcp-service-account":      "true",
+				"estafette.io/gcp-service-account-name": "app",
+			}),
+			Object: getSecretRaw(map[string]string{
+				"estafette.io/gcp-service-account":       "true",
+				"estafette.io/gcp-service-account-name":  "app",
+				"estafette.io/gcp-service-account-state": "{}",
+			}),
+		}
+
+		// act
+		response := validateObject(request)
+
+		assert.True(t, response.Allowed)
+	})
+
+	t.Run("ReturnsAllowedForUpdateThatOnlyAddsRevokeNowToSecretWithInvalidAnnotations", func(t *testing.T) {
+
+		request := &admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+			Operation: admissionv1.Update,
+			OldObject: getSecretRaw(map[string]string{
+				"estafette.io/gcp-service-account":                "true",
+				"estafette.io/gcp-service-account-name":           "my-application",
+				"estafette.io/gcp-service-account-derived-fields": "yes",
+			}),
+			Object: getSecretRaw(map[string]string{
+				"estafette.io/gcp-service-account":                "true",
+				"estafette.io/gcp-service-account-name":           "my-application",
+				"estafette.io/gcp-service-account-derived-fields": "yes",
+				"estafette.io/gcp-service-account-revoke-now":     "incident-1",
+			}),
+		}
+
+		// act
+		response := validateObject(request)
+
+		assert.True(t, response.Allowed)
+	})
+
+	t.Run("ReturnsAllowedForUpdateWithValidChangeToSecretWithOtherInvalidAnnotations", func(t *testing.T) {
+
+		request := &admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+			Operation: admissionv1.Update,
+			OldObject: getSecretRaw(map[string]string{
+				"estafette.io/gcp-service-account":                "true",
+				"estafette.io/gcp-service-account-name":           "my-application",
+				"estafette.io/gcp-service-account-derived-fields": "yes",
+			}),
+			Object: getSecretRaw(map[string]string{
+				"estafette.io/gcp-service-account":                "true",
+				"estafette.io/gcp-service-account-name":           "my-application",
+				"estafette.io/gcp-service-account-derived-fields": "yes",
+				"estafette.io/gcp-service-account-filename":       "key.json",
+			}),
+		}
+
+		// act
+		response := validateObject(request)
+
+		assert.True(t, response.Allowed)
+	})
+
+	t.Run("ReturnsDeniedForUpdateWithInvalidChange", func(t *testing.T) {
+
+		request := &admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Secret"},
+			Operation: admissionv1.Update,
+			OldObject: getSecretRaw(map[string]string{
+				"estafette.io/gcp-service-account":      "true",
+				"estafette.io/gcp-service-account-name": "my-application",
+			}),
+			Object: getSecretRaw(map[string]string{
+				"estafette.io/gcp-service-account":          "true",
+				"estafette.io/gcp-service-account-name":     "my-application",
+				"estafette.io/gcp-service-account-filename": "key/json",
+			}),
+		}
+
+		// act
+		response := validateObject(request)
+
+		assert.False(t, response.Allowed)
+	})
+}
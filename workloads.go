@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// annotationGCPServiceAccountKeyID is set on the pod template of restarted workloads to the id of the new key, which triggers a rolling restart
+const annotationGCPServiceAccountKeyID string = "estafette.io/gcp-service-account-key-id"
+
+// podSpecReferencesSecret returns true if the pod spec mounts the secret as a volume or references it from environment variables
+func podSpecReferencesSecret(podSpec v1.PodSpec, secretName string) bool {
+
+	for _, volume := range podSpec.Volumes {
+		if volume.Secret != nil && volume.Secret.SecretName == secretName {
+			return true
+		}
+		if volume.Projected != nil {
+			for _, source := range volume.Projected.Sources {
+				if source.Secret != nil && source.Secret.Name == secretName {
+					return true
+				}
+			}
+		}
+	}
+
+	containers := append([]v1.Container{}, podSpec.InitContainers...)
+	containers = append(containers, podSpec.Containers...)
+	for _, container := range containers {
+		for _, env := range container.Env {
+			if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil && env.ValueFrom.SecretKeyRef.Name == secretName {
+				return true
+			}
+		}
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.SecretRef != nil && envFrom.SecretRef.Name == secretName {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// getRestartPatch returns a strategic merge patch setting the key id annotation on a pod template
+func getRestartPatch(keyID string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						annotationGCPServiceAccountKeyID: keyID,
+					},
+				},
+			},
+		},
+	})
+}
+
+// restartConsumerWorkloads triggers a rolling restart of the deployments, statefulsets and daemonsets in the secret's namespace that consume the secret, so they pick up the new key
+func restartConsumerWorkloads(kubeClientset *kubernetes.Clientset, secret *v1.Secret, initiator, keyID string) (err error) {
+
+	patch, err := getRestartPatch(keyID)
+	if err != nil {
+		return
+	}
+
+	// patch and list errors are kept apart from err, so a later list can't overwrite an earlier failure
+	var restartErr error
+	restarted := []string{}
+	patchWorkload := func(kind, name string, patchFunc func() error) {
+		log.Info().Msgf("[%v] Secret %v.%v - Restarting %v %v to pick up key %v...", initiator, secret.Name, secret.Namespace, kind, name, keyID)
+		patchErr := patchFunc()
+		if patchErr != nil {
+			log.Error().Err(patchErr).Msgf("[%v] Secret %v.%v - Failed restarting %v %v", initiator, secret.Name, secret.Namespace, kind, name)
+			workloadRestartTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "failed", "initiator": initiator, "mode": *mode, "type": strings.ToLower(kind)}).Inc()
+			restartErr = patchErr
+			return
+		}
+		workloadRestartTotals.With(prometheus.Labels{"namespace": secret.Namespace, "status": "succeeded", "initiator": initiator, "mode": *mode, "type": strings.ToLower(kind)}).Inc()
+		restarted = append(restarted, fmt.Sprintf("%v %v", kind, name))
+	}
+
+	deployments, listErr := kubeClientset.AppsV1().Deployments(secret.Namespace).List(context.Background(), metav1.ListOptions{})
+	if listErr != nil {
+		log.Error().Err(listErr).Msgf("[%v] Secret %v.%v - Failed listing deployments to restart", initiator, secret.Name, secret.Namespace)
+		restartErr = listErr
+		deployments = &appsv1.DeploymentList{}
+	}
+	for _, deployment := range deployments.Items {
+		if podSpecReferencesSecret(deployment.Spec.Template.Spec, secret.Name) {
+			name := deployment.Name
+			patchWorkload("Deployment", name, func() error {
+				_, err := kubeClientset.AppsV1().Deployments(secret.Namespace).Patch(context.Background(), name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+				return err
+			})
+		}
+	}
+
+	statefulSets, listErr := kubeClientset.AppsV1().StatefulSets(secret.Namespace).List(context.Background(), metav1.ListOptions{})
+	if listErr != nil {
+		log.Error().Err(listErr).Msgf("[%v] Secret %v.%v - Failed listing statefulsets to restart", initiator, secret.Name, secret.Namespace)
+		restartErr = listErr
+		statefulSets = &appsv1.StatefulSetList{}
+	}
+	for _, statefulSet := range statefulSets.Items {
+		if podSpecReferencesSecret(statefulSet.Spec.Template.Spec, secret.Name) {
+			name := statefulSet.Name
+			patchWorkload("StatefulSet", name, func() error {
+				_, err := kubeClientset.AppsV1().StatefulSets(secret.Namespace).Patch(context.Background(), name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+				return err
+			})
+		}
+	}
+
+	daemonSets, listErr := kubeClientset.AppsV1().DaemonSets(secret.Namespace).List(context.Background(), metav1.ListOptions{})
+	if listErr != nil {
+		log.Error().Err(listErr).Msgf("[%v] Secret %v.%v - Failed listing daemonsets to restart", initiator, secret.Name, secret.Namespace)
+		restartErr = listErr
+		daemonSets = &appsv1.DaemonSetList{}
+	}
+	for _, daemonSet := range daemonSets.Items {
+		if podSpecReferencesSecret(daemonSet.Spec.Template.Spec, secret.Name) {
+			name := daemonSet.Name
+			patchWorkload("DaemonSet", name, func() error {
+				_, err := kubeClientset.AppsV1().DaemonSets(secret.Namespace).Patch(context.Background(), name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+				return err
+			})
+		}
+	}
+
+	if len(restarted) > 0 {
+		_ = createEvent(kubeClientset, getSecretObjectReference(secret), v1.EventTypeNormal, "WorkloadsRestarted", fmt.Sprintf("Restarted %v to pick up key %v", strings.Join(restarted, ", "), keyID))
+	}
+
+	return restartErr
+}
+
+// getStaleConsumerPods returns the names of running pods consuming the secret that were started before the last rotation and haven't acknowledged the current key id with the key id annotation
+func getStaleConsumerPods(pods []v1.Pod, secretName string, lastRenewed time.Time, keyID string) (stalePods []string) {
+
+	for _, pod := range pods {
+		if pod.Status.Phase != v1.PodRunning || !podSpecReferencesSecret(pod.Spec, secretName) {
+			continue
+		}
+		if startedAt := getPodContainersStartedAt(pod); !startedAt.IsZero() && startedAt.After(lastRenewed) {
+			continue
+		}
+		if keyID != "" && pod.ObjectMeta.Annotations[annotationGCPServiceAccountKeyID] == keyID {
+			continue
+		}
+		stalePods = append(stalePods, pod.Name)
+	}
+
+	return
+}
+
+// getPodContainersStartedAt returns when the longest running container of the pod has been (re)started, since a container restarted in place reads the secret again while the pod's start time stays the same; it falls back to the pod's start time if no container is running yet
+func getPodContainersStartedAt(pod v1.Pod) (startedAt time.Time) {
+
+	for _, containerStatus := range pod.Status.ContainerStatuses {
+		if containerStatus.State.Running == nil {
+			continue
+		}
+		if startedAt.IsZero() || containerStatus.State.Running.StartedAt.Time.Before(startedAt) {
+			startedAt = containerStatus.State.Running.StartedAt.Time
+		}
+	}
+
+	if startedAt.IsZero() && pod.Status.StartTime != nil {
+		startedAt = pod.Status.StartTime.Time
+	}
+
+	return
+}
+
+// listStaleConsumerPods returns the names of running pods in the secret's namespace that haven't picked up the key currently stored in the secret
+func listStaleConsumerPods(kubeClientset *kubernetes.Clientset, secret *v1.Secret, filename string, lastRenewed time.Time) (stalePods []string, err error) {
+
+	keyID := ""
+	if keyfile, err := parseServiceAccountKeyfile(secret.Data[filename]); err == nil {
+		keyID = keyfile.PrivateKeyID
+	}
+
+	pods, err := kubeClientset.CoreV1().Pods(secret.Namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return
+	}
+
+	return getStaleConsumerPods(pods.Items, secret.Name, lastRenewed, keyID), nil
+}
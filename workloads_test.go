@@ -0,0 +1,241 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodSpecReferencesSecret(t *testing.T) {
+	t.Run("ReturnsTrueIfSecretIsMountedAsVolume", func(t *testing.T) {
+
+		podSpec := v1.PodSpec{
+			Volumes: []v1.Volume{
+				{
+					Name: "gcp-service-account",
+					VolumeSource: v1.VolumeSource{
+						Secret: &v1.SecretVolumeSource{SecretName: "my-application-gcp-service-account"},
+					},
+				},
+			},
+		}
+
+		// act
+		references := podSpecReferencesSecret(podSpec, "my-application-gcp-service-account")
+
+		assert.True(t, references)
+	})
+
+	t.Run("ReturnsTrueIfSecretIsPartOfProjectedVolume", func(t *testing.T) {
+
+		podSpec := v1.PodSpec{
+			Volumes: []v1.Volume{
+				{
+					Name: "secrets",
+					VolumeSource: v1.VolumeSource{
+						Projected: &v1.ProjectedVolumeSource{
+							Sources: []v1.VolumeProjection{
+								{Secret: &v1.SecretProjection{LocalObjectReference: v1.LocalObjectReference{Name: "my-application-gcp-service-account"}}},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		// act
+		references := podSpecReferencesSecret(podSpec, "my-application-gcp-service-account")
+
+		assert.True(t, references)
+	})
+
+	t.Run("ReturnsTrueIfSecretIsReferencedFromEnvironmentVariable", func(t *testing.T) {
+
+		podSpec := v1.PodSpec{
+			Containers: []v1.Container{
+				{
+					Name: "my-application",
+					Env: []v1.EnvVar{
+						{
+							Name: "GCP_PRIVATE_KEY",
+							ValueFrom: &v1.EnvVarSource{
+								SecretKeyRef: &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "my-application-gcp-service-account"}, Key: "private_key"},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		// act
+		references := podSpecReferencesSecret(podSpec, "my-application-gcp-service-account")
+
+		assert.True(t, references)
+	})
+
+	t.Run("ReturnsTrueIfSecretIsReferencedFromInitContainerEnvFrom", func(t *testing.T) {
+
+		podSpec := v1.PodSpec{
+			InitContainers: []v1.Container{
+				{
+					Name: "init",
+					EnvFrom: []v1.EnvFromSource{
+						{SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "my-application-gcp-service-account"}}},
+					},
+				},
+			},
+		}
+
+		// act
+		references := podSpecReferencesSecret(podSpec, "my-application-gcp-service-account")
+
+		assert.True(t, references)
+	})
+
+	t.Run("ReturnsFalseIfSecretIsNotReferenced", func(t *testing.T) {
+
+		podSpec := v1.PodSpec{
+			Volumes: []v1.Volume{
+				{
+					Name: "other",
+					VolumeSource: v1.VolumeSource{
+						Secret: &v1.SecretVolumeSource{SecretName: "another-secret"},
+					},
+				},
+			},
+			Containers: []v1.Container{
+				{Name: "my-application"},
+			},
+		}
+
+		// act
+		references := podSpecReferencesSecret(podSpec, "my-application-gcp-service-account")
+
+		assert.False(t, references)
+	})
+}
+
+func TestGetRestartPatch(t *testing.T) {
+	t.Run("ReturnsPatchSettingKeyIDAnnotationOnPodTemplate", func(t *testing.T) {
+
+		// act
+		patch, err := getRestartPatch("0123456789abcdef")
+
+		assert.Nil(t, err)
+		assert.Equal(t, `{"spec":{"template":{"metadata":{"annotations":{"estafette.io/gcp-service-account-key-id":"0123456789abcdef"}}}}}`, string(patch))
+	})
+}
+
+func TestGetStaleConsumerPods(t *testing.T) {
+
+	lastRenewed := time.Date(2020, 11, 23, 10, 0, 0, 0, time.UTC)
+	consumerPod := func(name string, startTime time.Time, annotations map[string]string) v1.Pod {
+		return v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+			Spec: v1.PodSpec{
+				Volumes: []v1.Volume{
+					{
+						Name: "gcp-service-account",
+						VolumeSource: v1.VolumeSource{
+							Secret: &v1.SecretVolumeSource{SecretName: "my-application-gcp-service-account"},
+						},
+					},
+				},
+			},
+			Status: v1.PodStatus{
+				Phase:     v1.PodRunning,
+				StartTime: &metav1.Time{Time: startTime},
+			},
+		}
+	}
+
+	t.Run("ReturnsPodsStartedBeforeLastRotation", func(t *testing.T) {
+
+		pods := []v1.Pod{
+			consumerPod("my-application-old", lastRenewed.Add(-1*time.Hour), nil),
+			consumerPod("my-application-new", lastRenewed.Add(time.Hour), nil),
+		}
+
+		// act
+		stalePods := getStaleConsumerPods(pods, "my-application-gcp-service-account", lastRenewed, "0123456789abcdef")
+
+		assert.Equal(t, []string{"my-application-old"}, stalePods)
+	})
+
+	t.Run("ReturnsNoPodsWhoseContainersRestartedAfterLastRotation", func(t *testing.T) {
+
+		pod := consumerPod("my-application-restarted", lastRenewed.Add(-1*time.Hour), nil)
+		pod.Status.ContainerStatuses = []v1.ContainerStatus{
+			{Name: "my-application", State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: lastRenewed.Add(time.Hour)}}}},
+		}
+
+		// act
+		stalePods := getStaleConsumerPods([]v1.Pod{pod}, "my-application-gcp-service-account", lastRenewed, "0123456789abcdef")
+
+		assert.Equal(t, 0, len(stalePods))
+	})
+
+	t.Run("ReturnsPodsWithAContainerStartedBeforeLastRotation", func(t *testing.T) {
+
+		pod := consumerPod("my-application-sidecar", lastRenewed.Add(-1*time.Hour), nil)
+		pod.Status.ContainerStatuses = []v1.ContainerStatus{
+			{Name: "my-application", State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: lastRenewed.Add(time.Hour)}}}},
+			{Name: "sidecar", State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.Time{Time: lastRenewed.Add(-1 * time.Hour)}}}},
+		}
+
+		// act
+		stalePods := getStaleConsumerPods([]v1.Pod{pod}, "my-application-gcp-service-account", lastRenewed, "0123456789abcdef")
+
+		assert.Equal(t, []string{"my-application-sidecar"}, stalePods)
+	})
+
+	t.Run("ReturnsNoPodsThatAcknowledgedTheCurrentKey", func(t *testing.T) {
+
+		pods := []v1.Pod{
+			consumerPod("my-application-old", lastRenewed.Add(-1*time.Hour), map[string]string{annotationGCPServiceAccountKeyID: "0123456789abcdef"}),
+		}
+
+		// act
+		stalePods := getStaleConsumerPods(pods, "my-application-gcp-service-account", lastRenewed, "0123456789abcdef")
+
+		assert.Equal(t, 0, len(stalePods))
+	})
+
+	t.Run("ReturnsPodsThatAcknowledgedAnotherKey", func(t *testing.T) {
+
+		pods := []v1.Pod{
+			consumerPod("my-application-old", lastRenewed.Add(-1*time.Hour), map[string]string{annotationGCPServiceAccountKeyID: "fedcba9876543210"}),
+		}
+
+		// act
+		stalePods := getStaleConsumerPods(pods, "my-application-gcp-service-account", lastRenewed, "0123456789abcdef")
+
+		assert.Equal(t, []string{"my-application-old"}, stalePods)
+	})
+
+	t.Run("ReturnsNoPodsThatDoNotConsumeTheSecret", func(t *testing.T) {
+
+		pods := []v1.Pod{
+			consumerPod("my-application-old", lastRenewed.Add(-1*time.Hour), nil),
+		}
+
+		// act
+		stalePods := getStaleConsumerPods(pods, "another-secret", lastRenewed, "0123456789abcdef")
+
+		assert.Equal(t, 0, len(stalePods))
+	})
+
+	t.Run("ReturnsNoPodsThatAreNotRunning", func(t *testing.T) {
+
+		pod := consumerPod("my-application-old", lastRenewed.Add(-1*time.Hour), nil)
+		pod.Status.Phase = v1.PodSucceeded
+
+		// act
+		stalePods := getStaleConsumerPods([]v1.Pod{pod}, "my-application-gcp-service-account", lastRenewed, "0123456789abcdef")
+
+		assert.Equal(t, 0, len(stalePods))
+	})
+}